@@ -1,7 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"log"
 	"log/slog"
 	"os"
@@ -12,9 +15,12 @@ import (
 	"github.com/getsentry/sentry-go"
 	"github.com/nyaruka/ezconf"
 	"github.com/nyaruka/gocommon/aws/cwatch"
+	"github.com/nyaruka/gocommon/jsonx"
 	indexer "github.com/nyaruka/rp-indexer/v10"
 	"github.com/nyaruka/rp-indexer/v10/indexers"
 	"github.com/nyaruka/rp-indexer/v10/runtime"
+	"github.com/nyaruka/rp-indexer/v10/utils"
+	"github.com/nyaruka/rp-indexer/v10/watermarks"
 	slogmulti "github.com/samber/slog-multi"
 	slogsentry "github.com/samber/slog-sentry/v2"
 )
@@ -26,10 +32,22 @@ var (
 )
 
 func main() {
+	// exit with an error status if something failed, but only after run's deferred calls, e.g. flushing sentry
+	if err := run(); err != nil {
+		os.Exit(1)
+	}
+}
+
+// runs the indexer in the mode given by our config, returning an error, which has already been logged, if it fails
+func run() error {
 	cfg := runtime.NewDefaultConfig()
 	loader := ezconf.NewLoader(cfg, "indexer", "Indexes RapidPro contacts to ElasticSearch", []string{"indexer.toml"})
 	loader.MustLoad()
 
+	if err := cfg.Validate(); err != nil {
+		log.Fatalf("invalid config: %s", err)
+	}
+
 	var level slog.Level
 	err := level.UnmarshalText([]byte(cfg.LogLevel))
 	if err != nil {
@@ -69,6 +87,8 @@ func main() {
 	log := slog.With("comp", "main")
 	log.Info("starting indexer", "version", version, "released", date)
 
+	utils.SetCompression(cfg.ElasticGzip)
+
 	rt.DB, err = sql.Open("postgres", cfg.DB)
 	if err != nil {
 		log.Error("unable to connect to database", "error", err)
@@ -79,16 +99,75 @@ func main() {
 		log.Error("unable to create cloudwatch service", "error", err)
 	}
 
+	if rt.Config.WatermarkDB != "" {
+		watermarkDB, err := sql.Open("postgres", cfg.WatermarkDB)
+		if err != nil {
+			log.Error("unable to connect to watermarks database", "error", err)
+			return err
+		}
+
+		rt.Watermarks, err = watermarks.NewDBStore(context.Background(), watermarkDB)
+		if err != nil {
+			log.Error("unable to create watermarks store", "error", err)
+			return err
+		}
+	} else if rt.Config.WatermarkFile != "" {
+		rt.Watermarks = watermarks.NewFileStore(rt.Config.WatermarkFile)
+	}
+
 	idxrs := []indexers.Indexer{
-		indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, rt.Config.ContactsShards, rt.Config.ContactsReplicas, 500),
+		indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, rt.Config.ContactsShards, rt.Config.ContactsReplicas, rt.Config.ContactsBulkMaxDocs, rt.Config.ContactsBulkMaxBytes),
 	}
 
-	if rt.Config.Rebuild {
+	if rt.Config.SQLIndexers != "" {
+		sqlIdxrs, err := indexers.LoadSQLIndexers(rt.Config.ElasticURL, rt.Config.SQLIndexers)
+		if err != nil {
+			log.Error("unable to load SQL indexers", "error", err)
+			return err
+		}
+		for _, idxr := range sqlIdxrs {
+			idxrs = append(idxrs, idxr)
+		}
+	}
+
+	if rt.Config.Ignored {
+		// if reporting ignored values, just write the report for the contact index and quit
+		var contactIdxr *indexers.ContactIndexer
+		for _, idxr := range idxrs {
+			if cix, ok := idxr.(*indexers.ContactIndexer); ok {
+				contactIdxr = cix
+			}
+		}
+		if contactIdxr == nil {
+			err := errors.New("no contacts indexer to report ignored values for")
+			log.Error(err.Error())
+			return err
+		}
+
+		report, err := contactIdxr.ReportIgnored(context.Background())
+		if err != nil {
+			log.Error("error reporting ignored values", "error", err)
+			return err
+		}
+		fmt.Println(string(jsonx.MustMarshal(report)))
+	} else if rt.Config.Rollback {
+		// if rolling back, just point the alias at the previous index and quit
+		idxr := idxrs[0]
+		if _, err := idxr.Rollback(context.Background()); err != nil {
+			log.Error("error during rollback", "error", err, "indexer", idxr.Name())
+			return err
+		}
+	} else if rt.Config.Rebuild {
 		// if rebuilding, just do a complete index and quit. In future when we support multiple indexers,
-		// the rebuild argument can be become the name of the index to rebuild, e.g. --rebuild=contacts
+		// the rebuild argument can be become the name of the index to rebuild, e.g. --rebuild=contacts. Exit
+		// signals cancel the rebuild so we don't get killed mid-request.
+		ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+		defer stop()
+
 		idxr := idxrs[0]
-		if _, err := idxr.Index(rt, true, rt.Config.Cleanup); err != nil {
+		if _, err := idxr.Index(ctx, rt, true, rt.Config.Cleanup); err != nil {
 			log.Error("error during rebuilding", "error", err, "indexer", idxr.Name())
+			return err
 		}
 	} else {
 		d := indexer.NewDaemon(rt, idxrs)
@@ -96,6 +175,8 @@ func main() {
 
 		handleSignals(d)
 	}
+
+	return nil
 }
 
 // handleSignals takes care of trapping quit, interrupt or terminate signals and doing the right thing
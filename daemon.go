@@ -11,12 +11,15 @@ import (
 	"github.com/nyaruka/gocommon/aws/cwatch"
 	"github.com/nyaruka/rp-indexer/v10/indexers"
 	"github.com/nyaruka/rp-indexer/v10/runtime"
+	"github.com/nyaruka/rp-indexer/v10/utils"
 )
 
 type Daemon struct {
 	rt       *runtime.Runtime
 	wg       *sync.WaitGroup
 	quit     chan bool
+	ctx      context.Context // cancelled on stop to abort in-flight indexing
+	cancel   context.CancelFunc
 	indexers []indexers.Indexer
 	poll     time.Duration
 
@@ -25,10 +28,14 @@ type Daemon struct {
 
 // NewDaemon creates a new daemon to run the given indexers
 func NewDaemon(rt *runtime.Runtime, ixs []indexers.Indexer) *Daemon {
+	ctx, cancel := context.WithCancel(context.Background())
+
 	return &Daemon{
 		rt:        rt,
 		wg:        &sync.WaitGroup{},
 		quit:      make(chan bool),
+		ctx:       ctx,
+		cancel:    cancel,
 		indexers:  ixs,
 		poll:      time.Duration(rt.Config.Poll) * time.Second,
 		prevStats: make(map[indexers.Indexer]indexers.Stats, len(ixs)),
@@ -49,8 +56,20 @@ func (d *Daemon) startIndexer(indexer indexers.Indexer) {
 
 	log := slog.With("indexer", indexer.Name())
 
+	var lock *utils.Lock
+	var isLeader bool
+	if d.rt.Config.LeaderLock {
+		lock = utils.NewLock(d.rt.DB, indexer.LockName(d.rt.Config))
+	}
+
 	go func() {
 		defer func() {
+			if lock != nil {
+				if err := lock.Release(context.Background()); err != nil {
+					log.Error("error releasing leader lock", "error", err)
+				}
+			}
+
 			log.Info("indexer exiting")
 			d.wg.Done()
 		}()
@@ -60,9 +79,29 @@ func (d *Daemon) startIndexer(indexer indexers.Indexer) {
 			case <-d.quit:
 				return
 			case <-time.After(d.poll):
-				_, err := indexer.Index(d.rt, d.rt.Config.Rebuild, d.rt.Config.Cleanup)
+				// if we're using leader election, only index if we hold the lock for this indexer
+				if lock != nil {
+					leader, err := lock.Acquire(d.ctx)
+					if err != nil {
+						log.Error("error acquiring leader lock", "error", err)
+						leader = false
+					}
+					if leader != isLeader {
+						log.Info("leadership changed", "leader", leader)
+						isLeader = leader
+					}
+					if !isLeader {
+						continue
+					}
+				}
+
+				_, err := indexer.Index(d.ctx, d.rt, d.rt.Config.Rebuild, d.rt.Config.Cleanup)
 				if err != nil {
-					log.Error("error during indexing", "error", err)
+					if d.ctx.Err() != nil {
+						log.Info("indexing cancelled")
+					} else {
+						log.Error("error during indexing", "error", err)
+					}
 				}
 			}
 		}
@@ -99,7 +138,7 @@ func (d *Daemon) reportStats(includeLag bool) {
 	defer cancel()
 
 	log := slog.New(slog.Default().Handler())
-	metrics := make([]types.MetricDatum, 0, len(d.indexers)*3)
+	metrics := make([]types.MetricDatum, 0, len(d.indexers)*5)
 
 	for _, ix := range d.indexers {
 		stats := ix.Stats()
@@ -108,17 +147,25 @@ func (d *Daemon) reportStats(includeLag bool) {
 		indexedInPeriod := stats.Indexed - prev.Indexed
 		deletedInPeriod := stats.Deleted - prev.Deleted
 		elapsedInPeriod := stats.Elapsed - prev.Elapsed
+		sanitizedInPeriod := stats.Sanitized - prev.Sanitized
 		rateInPeriod := float64(0)
 		if indexedInPeriod > 0 && elapsedInPeriod > 0 {
 			rateInPeriod = float64(indexedInPeriod) / (float64(elapsedInPeriod) / float64(time.Second))
 		}
 
+		outdated := float64(0)
+		if stats.Outdated {
+			outdated = 1
+		}
+
 		idxDim := cwatch.Dimension("Index", ix.Name())
 
 		metrics = append(metrics,
 			cwatch.Datum("RecordsIndexed", float64(indexedInPeriod), types.StandardUnitCount, idxDim),
 			cwatch.Datum("RecordsDeleted", float64(deletedInPeriod), types.StandardUnitCount, idxDim),
 			cwatch.Datum("IndexingRate", rateInPeriod, types.StandardUnitCountSecond, idxDim),
+			cwatch.Datum("ValuesSanitized", float64(sanitizedInPeriod), types.StandardUnitCount, idxDim),
+			cwatch.Datum("IndexOutdated", outdated, types.StandardUnitCount, idxDim),
 		)
 
 		d.prevStats[ix] = stats
@@ -130,6 +177,27 @@ func (d *Daemon) reportStats(includeLag bool) {
 			} else {
 				metrics = append(metrics, cwatch.Datum("IndexingLag", lag.Seconds(), types.StandardUnitSeconds, idxDim))
 			}
+
+			ignored, err := ix.CountIgnored(ctx)
+			if err != nil {
+				log.Error("error counting ignored values", "index", ix.Name(), "error", err)
+			} else {
+				metrics = append(metrics, cwatch.Datum("DocumentsWithIgnoredValues", float64(ignored), types.StandardUnitCount, idxDim))
+			}
+
+			// for contacts, also report the orgs and fields with the most ignored values
+			if cix, ok := ix.(*indexers.ContactIndexer); ok {
+				metrics = append(metrics, d.ignoredMetrics(ctx, cix, idxDim)...)
+			}
+		}
+	}
+
+	if includeLag {
+		lag, err := utils.ReplicationLag(ctx, d.rt.DB)
+		if err != nil {
+			log.Error("error getting db replication lag", "error", err)
+		} else {
+			metrics = append(metrics, cwatch.Datum("ReplicationLag", lag.Seconds(), types.StandardUnitSeconds))
 		}
 	}
 
@@ -140,10 +208,37 @@ func (d *Daemon) reportStats(includeLag bool) {
 	log.Info("stats reported")
 }
 
-func (d *Daemon) calculateLag(ctx context.Context, ix indexers.Indexer) (time.Duration, error) {
-	esLastModified, err := ix.GetESLastModified(ctx, ix.Name())
+// number of orgs and fields with the most ignored values to report metrics for
+const ignoredMetricsTop = 10
+
+func (d *Daemon) ignoredMetrics(ctx context.Context, ix *indexers.ContactIndexer, idxDim types.Dimension) []types.MetricDatum {
+	report, err := ix.ReportIgnored(ctx)
 	if err != nil {
-		return 0, fmt.Errorf("error getting ES last modified: %w", err)
+		slog.Error("error reporting ignored values", "index", ix.Name(), "error", err)
+		return nil
+	}
+
+	metrics := make([]types.MetricDatum, 0, ignoredMetricsTop*2)
+	for _, c := range report.TopOrgs(ignoredMetricsTop) {
+		metrics = append(metrics, cwatch.Datum("IgnoredValues", float64(c.Count), types.StandardUnitCount, idxDim, cwatch.Dimension("Org", c.Key)))
+	}
+	for _, c := range report.TopFields(ignoredMetricsTop) {
+		metrics = append(metrics, cwatch.Datum("IgnoredValues", float64(c.Count), types.StandardUnitCount, idxDim, cwatch.Dimension("Field", c.Key)))
+	}
+	return metrics
+}
+
+// calculates indexing lag from how far the indexer has got, which can be further than the newest document in ES if
+// the newest records were skipped because their content hadn't changed. If the indexer hasn't run yet, we fall back
+// to the newest document in ES.
+func (d *Daemon) calculateLag(ctx context.Context, ix indexers.Indexer) (time.Duration, error) {
+	indexedLastModified := ix.Stats().LastModified
+	if indexedLastModified.IsZero() {
+		var err error
+		indexedLastModified, err = ix.GetESLastModified(ctx, ix.Name())
+		if err != nil {
+			return 0, fmt.Errorf("error getting ES last modified: %w", err)
+		}
 	}
 
 	dbLastModified, err := ix.GetDBLastModified(ctx, d.rt.DB)
@@ -151,7 +246,7 @@ func (d *Daemon) calculateLag(ctx context.Context, ix indexers.Indexer) (time.Du
 		return 0, fmt.Errorf("error getting DB last modified: %w", err)
 	}
 
-	return dbLastModified.Sub(esLastModified), nil
+	return dbLastModified.Sub(indexedLastModified), nil
 }
 
 // Stop stops this daemon
@@ -159,5 +254,6 @@ func (d *Daemon) Stop() {
 	slog.Info("daemon stopping")
 
 	close(d.quit)
+	d.cancel()
 	d.wg.Wait()
 }
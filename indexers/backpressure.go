@@ -0,0 +1,181 @@
+package indexers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/rp-indexer/v10/utils"
+)
+
+const (
+	backpressureCheckInterval = 10 * time.Second // how often we check cluster health whilst indexing
+	backpressureMinPause      = time.Second      // initial pause when the cluster is struggling
+	backpressureMaxPause      = time.Minute      // longest single pause
+	backpressureMaxWait       = 10 * time.Minute // longest we'll wait in total before giving up
+)
+
+// backpressure pauses indexing whilst the ES cluster is struggling, i.e. when it's red, its write queues are nearly
+// full or it's rejecting our requests, backing off exponentially the longer that goes on.
+type backpressure struct {
+	elasticURL string
+
+	mu          sync.Mutex
+	lastCheck   time.Time
+	pausedUntil time.Time
+	pauses      int              // consecutive pauses, used to calculate backoff
+	rejected    map[string]int64 // write thread pool rejections by node as of last check
+	unchecked   bool             // whether our last check failed, so we only log failures once
+}
+
+func newBackpressure(elasticURL string) *backpressure {
+	return &backpressure{elasticURL: elasticURL}
+}
+
+// our response for cluster health
+type clusterHealthResponse struct {
+	Status string `json:"status"`
+}
+
+// our response for write thread pool stats, which ES returns as strings
+type threadPoolResponse []struct {
+	NodeName  string `json:"node_name"`
+	Queue     string `json:"queue"`
+	QueueSize string `json:"queue_size"`
+	Rejected  string `json:"rejected"`
+}
+
+// checks the health of the cluster, returning a reason if it's struggling
+func (b *backpressure) check(ctx context.Context) (string, error) {
+	health := &clusterHealthResponse{}
+	if _, err := utils.MakeQuietJSONRequest(ctx, http.MethodGet, fmt.Sprintf("%s/_cluster/health", b.elasticURL), nil, health); err != nil {
+		return "", fmt.Errorf("error checking cluster health: %w", err)
+	}
+	if health.Status == "red" {
+		return "cluster is red", nil
+	}
+
+	pools := threadPoolResponse{}
+	if _, err := utils.MakeQuietJSONRequest(ctx, http.MethodGet, fmt.Sprintf("%s/_cat/thread_pool/write?format=json&h=node_name,queue,queue_size,rejected", b.elasticURL), nil, &pools); err != nil {
+		return "", fmt.Errorf("error checking thread pools: %w", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	prevRejected := b.rejected
+	b.rejected = make(map[string]int64, len(pools))
+	reason := ""
+
+	for _, p := range pools {
+		queue, _ := strconv.Atoi(p.Queue)
+		queueSize, _ := strconv.Atoi(p.QueueSize)
+		rejected, _ := strconv.ParseInt(p.Rejected, 10, 64)
+
+		b.rejected[p.NodeName] = rejected
+
+		if queueSize > 0 && queue*10 >= queueSize*9 {
+			reason = fmt.Sprintf("write queue on %s is saturated", p.NodeName)
+		} else if prev, seen := prevRejected[p.NodeName]; seen && rejected > prev {
+			reason = fmt.Sprintf("write thread pool on %s rejected %d requests", p.NodeName, rejected-prev)
+		}
+	}
+
+	return reason, nil
+}
+
+// Trip pauses indexing, for at least the given duration if ES asked us to wait that long
+func (b *backpressure) Trip(reason string, retryAfter time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	pause := min(backpressureMinPause<<min(b.pauses, 10), backpressureMaxPause)
+	pause = max(pause, retryAfter)
+	b.pauses++
+
+	if until := time.Now().Add(pause); until.After(b.pausedUntil) {
+		b.pausedUntil = until
+	}
+
+	// make sure we check the cluster again before resuming
+	b.lastCheck = time.Time{}
+
+	slog.Warn("pausing indexing", "reason", reason, "pause", pause)
+}
+
+// Reset clears our backoff after a successful request
+func (b *backpressure) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.pauses = 0
+}
+
+// records whether we were able to check the cluster, logging when that changes rather than on every check
+func (b *backpressure) setUnchecked(unchecked bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if unchecked && !b.unchecked {
+		slog.Warn("unable to check cluster for backpressure, not throttling", "error", err)
+	} else if !unchecked && b.unchecked {
+		slog.Info("able to check cluster for backpressure again")
+	}
+	b.unchecked = unchecked
+}
+
+// Wait blocks whilst indexing is paused, periodically checking the cluster health, and errors if the cluster is
+// still struggling after our maximum wait. If the cluster health can't be checked, we don't block.
+func (b *backpressure) Wait(ctx context.Context) error {
+	deadline := time.Now().Add(backpressureMaxWait)
+
+	for {
+		b.mu.Lock()
+		pausedFor := time.Until(b.pausedUntil)
+		checkDue := time.Since(b.lastCheck) >= backpressureCheckInterval
+		if checkDue && pausedFor <= 0 {
+			b.lastCheck = time.Now()
+		}
+		b.mu.Unlock()
+
+		if pausedFor > 0 {
+			if time.Now().Add(pausedFor).After(deadline) {
+				return fmt.Errorf("elastic cluster still unavailable after waiting %s", backpressureMaxWait)
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pausedFor):
+			}
+			continue
+		}
+
+		if !checkDue {
+			return nil
+		}
+
+		reason, err := b.check(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			// we can't tell if the cluster is struggling, e.g. because we lack the monitor privilege or there's a proxy
+			// in front of ES, so rather than block indexing, don't throttle it
+			b.setUnchecked(true, err)
+			return nil
+		}
+		b.setUnchecked(false, nil)
+
+		if reason == "" {
+			return nil
+		}
+
+		b.Trip(reason, 0)
+	}
+}
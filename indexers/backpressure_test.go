@@ -0,0 +1,144 @@
+package indexers_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/rp-indexer/v10/indexers"
+	"github.com/stretchr/testify/assert"
+)
+
+// fake ES which responds to cluster health and thread pool requests with the given responses
+func newClusterServer(t *testing.T, health string, pools *[]string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/_cluster/health":
+			w.Write([]byte(`{"status": "` + health + `"}`))
+		case "/_cat/thread_pool/write":
+			if pools == nil {
+				w.WriteHeader(http.StatusForbidden)
+				w.Write([]byte(`{"error": "no monitor privilege"}`))
+				return
+			}
+			next := (*pools)[0]
+			if len(*pools) > 1 {
+				*pools = (*pools)[1:]
+			}
+			w.Write([]byte(next))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestBackpressureTrip(t *testing.T) {
+	assertPausedFor := func(b *indexers.Backpressure, expected time.Duration) {
+		t.Helper()
+		actual := b.PausedFor()
+		assert.True(t, actual > expected-time.Second && actual <= expected, "expected pause of %s, got %s", expected, actual)
+	}
+
+	b := indexers.NewBackpressure("http://localhost:9200")
+	assert.LessOrEqual(t, b.PausedFor(), time.Duration(0))
+
+	// pauses back off exponentially
+	b.Trip("cluster is red", 0)
+	assertPausedFor(b, time.Second)
+	b.Trip("cluster is red", 0)
+	assertPausedFor(b, 2*time.Second)
+	b.Trip("cluster is red", 0)
+	assertPausedFor(b, 4*time.Second)
+
+	// up to our maximum single pause
+	for range 10 {
+		b.Trip("cluster is red", 0)
+	}
+	assertPausedFor(b, time.Minute)
+
+	// a reset clears the backoff, but doesn't shorten the current pause
+	b.Reset()
+	b.Trip("cluster is red", 0)
+	assertPausedFor(b, time.Minute)
+
+	b = indexers.NewBackpressure("http://localhost:9200")
+	b.Trip("cluster is red", 0)
+	b.Reset()
+	b.Trip("cluster is red", 0)
+	assertPausedFor(b, time.Second)
+
+	// if ES asks us to wait longer, we do
+	b = indexers.NewBackpressure("http://localhost:9200")
+	b.Trip("bulk request rejected", 30*time.Second)
+	assertPausedFor(b, 30*time.Second)
+
+	// but not shorter
+	b = indexers.NewBackpressure("http://localhost:9200")
+	b.Trip("cluster is red", 0)
+	b.Trip("bulk request rejected", 10*time.Millisecond)
+	assertPausedFor(b, 2*time.Second)
+}
+
+func TestBackpressureCheck(t *testing.T) {
+	ctx := context.Background()
+
+	// a red cluster is struggling
+	ts := newClusterServer(t, "red", &[]string{`[]`})
+	reason, err := indexers.NewBackpressure(ts.URL).Check(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "cluster is red", reason)
+
+	// as is one with a nearly full write queue
+	ts = newClusterServer(t, "yellow", &[]string{`[{"node_name": "es1", "queue": "10", "queue_size": "1000", "rejected": "0"}, {"node_name": "es2", "queue": "900", "queue_size": "1000", "rejected": "0"}]`})
+	reason, err = indexers.NewBackpressure(ts.URL).Check(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "write queue on es2 is saturated", reason)
+
+	// or one rejecting more writes since we last checked
+	ts = newClusterServer(t, "green", &[]string{
+		`[{"node_name": "es1", "queue": "0", "queue_size": "1000", "rejected": "5"}]`,
+		`[{"node_name": "es1", "queue": "0", "queue_size": "1000", "rejected": "5"}]`,
+		`[{"node_name": "es1", "queue": "0", "queue_size": "1000", "rejected": "8"}]`,
+	})
+	b := indexers.NewBackpressure(ts.URL)
+	for _, expected := range []string{"", "", "write thread pool on es1 rejected 3 requests"} {
+		reason, err = b.Check(ctx)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, reason)
+	}
+
+	// we error if we can't read the thread pools
+	ts = newClusterServer(t, "green", nil)
+	_, err = indexers.NewBackpressure(ts.URL).Check(ctx)
+	assert.ErrorContains(t, err, "error checking thread pools: received non-200 response 403")
+}
+
+func TestBackpressureWait(t *testing.T) {
+	ctx := context.Background()
+
+	// a healthy cluster doesn't block
+	ts := newClusterServer(t, "green", &[]string{`[{"node_name": "es1", "queue": "0", "queue_size": "1000", "rejected": "0"}]`})
+	b := indexers.NewBackpressure(ts.URL)
+	assert.NoError(t, b.Wait(ctx))
+	assert.LessOrEqual(t, b.PausedFor(), time.Duration(0))
+
+	// and neither does one we can't check
+	ts = newClusterServer(t, "green", nil)
+	b = indexers.NewBackpressure(ts.URL)
+	assert.NoError(t, b.Wait(ctx))
+	assert.NoError(t, b.Wait(ctx))
+
+	// but a struggling cluster pauses us until it recovers or we're cancelled
+	ts = newClusterServer(t, "red", &[]string{`[]`})
+	b = indexers.NewBackpressure(ts.URL)
+
+	waitCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+
+	assert.Equal(t, context.DeadlineExceeded, b.Wait(waitCtx))
+	assert.Greater(t, b.PausedFor(), time.Duration(0))
+}
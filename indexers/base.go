@@ -6,8 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
-	"sort"
+	"slices"
 	"strings"
 	"time"
 
@@ -22,17 +23,28 @@ const indexCommand = `{ "index": { "_id": %d, "version": %d, "version_type": "ex
 // deletes a document
 const deleteCommand = `{ "delete" : { "_id": %d, "version": %d, "version_type": "external", "routing": %d} }`
 
+// how far before our watermark we look for modified documents, which is widened by any replication lag of the database
+const indexLookback = 5 * time.Second
+
 type Stats struct {
 	Indexed int64         // total number of documents indexed
 	Deleted int64         // total number of documents deleted
 	Elapsed time.Duration // total time spent actually indexing (excludes poll delay)
+
+	Sanitized int64 // total number of document values which were fixed or removed before indexing
+	Outdated  bool  // whether the current index was created with a different definition and needs rebuilt
+
+	LastModified time.Time // modified time of the newest record indexing has reached, including skipped ones
 }
 
 // Indexer is base interface for indexers
 type Indexer interface {
 	Name() string
-	Index(rt *runtime.Runtime, rebuild, cleanup bool) (string, error)
+	LockName(cfg *runtime.Config) string
+	Index(ctx context.Context, rt *runtime.Runtime, rebuild, cleanup bool) (string, error)
+	Rollback(ctx context.Context) (string, error)
 	Stats() Stats
+	CountIgnored(ctx context.Context) (int, error)
 
 	GetESLastModified(ctx context.Context, index string) (time.Time, error)
 	GetDBLastModified(ctx context.Context, db *sql.DB) (time.Time, error)
@@ -43,11 +55,13 @@ type Indexer interface {
 type IndexDefinition struct {
 	Settings struct {
 		Index struct {
-			NumberOfShards       int `json:"number_of_shards"`
-			NumberOfReplicas     int `json:"number_of_replicas"`
-			RoutingPartitionSize int `json:"routing_partition_size"`
+			NumberOfShards       int    `json:"number_of_shards"`
+			NumberOfReplicas     int    `json:"number_of_replicas"`
+			RoutingPartitionSize int    `json:"routing_partition_size,omitempty"`
+			RefreshInterval      string `json:"refresh_interval,omitempty"`
+			TranslogDurability   string `json:"translog.durability,omitempty"`
 		} `json:"index"`
-		Analysis json.RawMessage `json:"analysis"`
+		Analysis json.RawMessage `json:"analysis,omitempty"`
 	} `json:"settings"`
 	Mappings json.RawMessage `json:"mappings"`
 }
@@ -61,22 +75,51 @@ func newIndexDefinition(base []byte, shards, replicas int) *IndexDefinition {
 	return d
 }
 
+// returns a copy of this definition with settings for faster bulk loading, i.e. no replicas, no refreshes and
+// asynchronous translog writes, which are restored by restoreIndexSettings once loading is complete
+func (d *IndexDefinition) forBulkLoading() *IndexDefinition {
+	c := *d
+	c.Settings.Index.NumberOfReplicas = 0
+	c.Settings.Index.RefreshInterval = "-1"
+	c.Settings.Index.TranslogDurability = "async"
+	return &c
+}
+
 type baseIndexer struct {
 	elasticURL string
 	name       string // e.g. contacts, used as the alias
 	definition *IndexDefinition
+	pressure   *backpressure
+	sizer      *bulkSizer
+	hashes     *hashCache // content hashes of recently indexed documents, if enabled
+
+	rebuildIndex    string           // the index we're currently rebuilding, if any
+	rebuildProgress *rebuildProgress // and its progress
+
+	checkedIndex string // the last index whose definition we checked
 
 	stats Stats
 }
 
-func newBaseIndexer(elasticURL, name string, def *IndexDefinition) baseIndexer {
-	return baseIndexer{elasticURL: elasticURL, name: name, definition: def}
+func newBaseIndexer(elasticURL, name string, def *IndexDefinition, maxBatchDocs, maxBatchBytes int) baseIndexer {
+	return baseIndexer{
+		elasticURL: elasticURL,
+		name:       name,
+		definition: def,
+		pressure:   newBackpressure(elasticURL),
+		sizer:      newBulkSizer(maxBatchDocs, maxBatchBytes),
+	}
 }
 
 func (i *baseIndexer) Name() string {
 	return i.name
 }
 
+// LockName returns the name of the leader lock for this indexer
+func (i *baseIndexer) LockName(cfg *runtime.Config) string {
+	return i.name
+}
+
 func (i *baseIndexer) Stats() Stats {
 	return i.stats
 }
@@ -94,6 +137,16 @@ func (i *baseIndexer) recordActivity(indexed, deleted int, elapsed time.Duration
 	i.log().Info("completed indexing", "indexed", indexed, "deleted", deleted, "elapsed", elapsed)
 }
 
+// records values which were sanitized in documents we indexed, and reports them by org so that bad values aren't
+// silently lost
+func (i *baseIndexer) recordSanitized(byOrg map[int64]*sanitizedValues) {
+	for orgID, s := range byOrg {
+		i.stats.Sanitized += int64(s.values)
+
+		i.log().Warn("sanitized document values", "org_id", orgID, "documents", s.documents, "values", s.values, "examples", s.examples)
+	}
+}
+
 // our response for figuring out the physical index for an alias
 type infoResponse map[string]interface{}
 
@@ -114,7 +167,7 @@ func (i *baseIndexer) FindIndexes(ctx context.Context) []string {
 	}
 
 	// reverse sort order should put our newest index first
-	sort.Sort(sort.Reverse(sort.StringSlice(indexes)))
+	slices.SortFunc(indexes, newestIndexFirst)
 
 	i.log().Debug("found physical indexes", "indexes", indexes)
 
@@ -135,10 +188,16 @@ func (i *baseIndexer) createNewIndex(ctx context.Context, def *IndexDefinition)
 
 	// check if it exists
 	for {
-		resp, err := http.Get(fmt.Sprintf("%s/%s", i.elasticURL, index))
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, fmt.Sprintf("%s/%s", i.elasticURL, index), nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
 			return "", err
 		}
+		resp.Body.Close()
+
 		// not found, great, move on
 		if resp.StatusCode == http.StatusNotFound {
 			break
@@ -157,6 +216,11 @@ func (i *baseIndexer) createNewIndex(ctx context.Context, def *IndexDefinition)
 		return "", err
 	}
 
+	// record the definition it was created with so that we can tell if it's out of date
+	if err := i.setIndexMeta(ctx, index, &indexMeta{Definition: i.definitionHash()}); err != nil {
+		return "", fmt.Errorf("error storing index meta: %w", err)
+	}
+
 	// all went well, return our physical index name
 	i.log().Info("created new index", "index", index)
 
@@ -221,8 +285,84 @@ type healthResponse struct {
 	} `json:"indices"`
 }
 
-// removes all indexes that are older than the currently active index
-func (i *baseIndexer) cleanupIndexes(ctx context.Context) error {
+// orders physical index names so that the newest comes first
+func newestIndexFirst(a, b string) int {
+	return utils.CompareIndexNames(b, a)
+}
+
+// finds all physical indexes for this indexer, whether aliased or not, sorted newest first
+func (i *baseIndexer) findAllIndexes(ctx context.Context) ([]string, error) {
+	healthResponse := healthResponse{}
+	_, err := utils.MakeJSONRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%s", i.elasticURL, "_cluster/health?level=indices"), nil, &healthResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	indexes := make([]string, 0)
+	for key := range healthResponse.Indices {
+		if strings.HasPrefix(key, i.name+"_") {
+			indexes = append(indexes, key)
+		}
+	}
+
+	slices.SortFunc(indexes, newestIndexFirst)
+
+	return indexes, nil
+}
+
+// our response for getting or creating a snapshot
+type snapshotResponse struct {
+	Snapshot struct {
+		Snapshot string `json:"snapshot"`
+		State    string `json:"state"`
+	} `json:"snapshot"`
+	Snapshots []struct {
+		Snapshot string `json:"snapshot"`
+		State    string `json:"state"`
+	} `json:"snapshots"`
+}
+
+// snapshots the given index to the given repository, waiting for the snapshot to complete. Snapshots are named
+// after the index, and a successful one left by a previous cleanup is reused.
+func (i *baseIndexer) snapshotIndex(ctx context.Context, repository, index string) error {
+	snapshotURL := fmt.Sprintf("%s/_snapshot/%s/%s", i.elasticURL, repository, index)
+
+	existing := snapshotResponse{}
+	_, err := utils.MakeJSONRequest(ctx, http.MethodGet, snapshotURL+"?ignore_unavailable=true", nil, &existing)
+	if err != nil {
+		return err
+	}
+	if len(existing.Snapshots) > 0 {
+		if existing.Snapshots[0].State == "SUCCESS" {
+			i.log().Info("found existing snapshot of old index", "index", index, "repository", repository)
+			return nil
+		}
+
+		// remove failed or partial snapshot so we can try again
+		if _, err := utils.MakeJSONRequest(ctx, http.MethodDelete, snapshotURL, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	body := jsonx.MustMarshal(map[string]any{"indices": index, "include_global_state": false})
+
+	created := snapshotResponse{}
+	_, err = utils.MakeJSONRequest(ctx, http.MethodPut, snapshotURL+"?wait_for_completion=true", body, &created)
+	if err != nil {
+		return err
+	}
+	if created.Snapshot.State != "SUCCESS" {
+		return fmt.Errorf("snapshot of index %s finished with state %s", index, created.Snapshot.State)
+	}
+
+	i.log().Info("created snapshot of old index", "index", index, "repository", repository)
+
+	return nil
+}
+
+// removes indexes that are older than the currently active index, keeping the newest retain of them. If a
+// snapshot repository is given, each index is snapshotted there before it is removed.
+func (i *baseIndexer) cleanupIndexes(ctx context.Context, retain int, snapshotRepository string) error {
 	// find our current indexes
 	currents := i.FindIndexes(ctx)
 
@@ -231,19 +371,29 @@ func (i *baseIndexer) cleanupIndexes(ctx context.Context) error {
 		return nil
 	}
 
-	// find all the current indexes
-	healthResponse := healthResponse{}
-	_, err := utils.MakeJSONRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%s", i.elasticURL, "_cluster/health?level=indices"), nil, &healthResponse)
+	all, err := i.findAllIndexes(ctx)
 	if err != nil {
 		return err
 	}
 
-	// for each active index, if it starts with our alias but is before our current index, remove it
-	for key := range healthResponse.Indices {
-		if strings.HasPrefix(key, i.name) && strings.Compare(key, currents[0]) < 0 {
-			slog.Info("removing old index", "index", key)
-			_, err = utils.MakeJSONRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%s", i.elasticURL, key), nil, nil)
-			if err != nil {
+	// for each index that is before our current index, retain the newest ones and remove the rest
+	retained := 0
+	for _, idx := range all {
+		if utils.CompareIndexNames(idx, currents[0]) < 0 {
+			if retained < retain {
+				i.log().Info("retaining old index", "index", idx)
+				retained++
+				continue
+			}
+
+			if snapshotRepository != "" {
+				if err := i.snapshotIndex(ctx, snapshotRepository, idx); err != nil {
+					return fmt.Errorf("error snapshotting index %s: %w", idx, err)
+				}
+			}
+
+			i.log().Info("removing old index", "index", idx)
+			if err := i.deleteIndex(ctx, idx); err != nil {
 				return err
 			}
 		}
@@ -252,6 +402,187 @@ func (i *baseIndexer) cleanupIndexes(ctx context.Context) error {
 	return nil
 }
 
+// deletes the given physical index
+func (i *baseIndexer) deleteIndex(ctx context.Context, index string) error {
+	_, err := utils.MakeJSONRequest(ctx, http.MethodDelete, fmt.Sprintf("%s/%s", i.elasticURL, index), nil, nil)
+	return err
+}
+
+// Rollback maps this indexer's alias back to the newest physical index older than the current one
+func (i *baseIndexer) Rollback(ctx context.Context) (string, error) {
+	currents := i.FindIndexes(ctx)
+	if len(currents) == 0 {
+		return "", fmt.Errorf("no current index for alias %s", i.name)
+	}
+
+	all, err := i.findAllIndexes(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, idx := range all {
+		if utils.CompareIndexNames(idx, currents[0]) < 0 {
+			if err := i.updateAlias(ctx, idx); err != nil {
+				return "", fmt.Errorf("error updating alias: %w", err)
+			}
+
+			i.log().Info("rolled back alias", "from", currents[0], "to", idx)
+
+			return idx, nil
+		}
+	}
+
+	return "", fmt.Errorf("no index older than %s to roll back to", currents[0])
+}
+
+// our response for the health of a single index
+type indexHealthResponse struct {
+	Status             string `json:"status"`
+	TimedOut           bool   `json:"timed_out"`
+	UnassignedShards   int    `json:"unassigned_shards"`
+	InitializingShards int    `json:"initializing_shards"`
+}
+
+// checks that the given index is green, i.e. all its primaries and replicas are allocated, waiting up to the given
+// timeout for it
+func (i *baseIndexer) checkIndexHealth(ctx context.Context, index string, timeout time.Duration) error {
+	healthURL := fmt.Sprintf("%s/_cluster/health/%s", i.elasticURL, index)
+
+	health := &indexHealthResponse{}
+	resp, err := utils.MakeJSONRequest(ctx, http.MethodGet, fmt.Sprintf("%s?wait_for_status=green&timeout=%ds", healthURL, int(timeout.Seconds())), nil, health)
+
+	// if we timed out waiting, ES responds with a 408 so get the current status without waiting
+	if resp != nil && resp.StatusCode == http.StatusRequestTimeout {
+		health.TimedOut = true
+		_, err = utils.MakeJSONRequest(ctx, http.MethodGet, healthURL, nil, health)
+	}
+	if err != nil {
+		return fmt.Errorf("error checking health of index %s: %w", index, err)
+	}
+	if health.TimedOut || health.Status != "green" {
+		return fmt.Errorf("index %s not green after %s, status is %s", index, timeout, health.Status)
+	}
+	if health.UnassignedShards > 0 || health.InitializingShards > 0 {
+		return fmt.Errorf("index has %d unassigned and %d initializing shards", health.UnassignedShards, health.InitializingShards)
+	}
+	return nil
+}
+
+// restores the settings of an index which was created for bulk loading, optionally force merging it first so that
+// replicas are built from fewer segments, and then waiting up to the given timeout for its replicas to be allocated
+func (i *baseIndexer) restoreIndexSettings(ctx context.Context, index string, forceMerge bool, replicasTimeout time.Duration) error {
+	if forceMerge {
+		i.log().Info("force merging index", "index", index)
+
+		if _, err := utils.MakeJSONRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/_forcemerge?max_num_segments=1", i.elasticURL, index), nil, nil); err != nil {
+			return fmt.Errorf("error force merging index: %w", err)
+		}
+	}
+
+	// null settings revert to the defaults
+	settings := jsonx.MustMarshal(map[string]any{
+		"index": map[string]any{
+			"number_of_replicas":  i.definition.Settings.Index.NumberOfReplicas,
+			"refresh_interval":    nil,
+			"translog.durability": nil,
+		},
+	})
+
+	if _, err := utils.MakeJSONRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%s/_settings", i.elasticURL, index), settings, nil); err != nil {
+		return fmt.Errorf("error updating index settings: %w", err)
+	}
+	if _, err := utils.MakeJSONRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/_refresh", i.elasticURL, index), nil, nil); err != nil {
+		return fmt.Errorf("error refreshing index: %w", err)
+	}
+
+	if err := i.checkIndexHealth(ctx, index, replicasTimeout); err != nil {
+		return fmt.Errorf("error waiting for replicas: %w", err)
+	}
+
+	i.log().Info("restored index settings", "index", index, "replicas", i.definition.Settings.Index.NumberOfReplicas)
+
+	return nil
+}
+
+// our response for counting documents
+type countResponse struct {
+	Count int `json:"count"`
+}
+
+// counts the documents in the given index, refreshing it first so that all indexed documents are counted
+func (i *baseIndexer) countDocs(ctx context.Context, index string) (int, error) {
+	if _, err := utils.MakeJSONRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/_refresh", i.elasticURL, index), nil, nil); err != nil {
+		return 0, err
+	}
+
+	count := &countResponse{}
+	if _, err := utils.MakeJSONRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%s/_count", i.elasticURL, index), nil, count); err != nil {
+		return 0, err
+	}
+	return count.Count, nil
+}
+
+// our response for a page of a composite aggregation by org
+type orgCountsResponse struct {
+	Aggregations struct {
+		Orgs struct {
+			AfterKey *struct {
+				OrgID int64 `json:"org_id"`
+			} `json:"after_key"`
+			Buckets []struct {
+				Key struct {
+					OrgID int64 `json:"org_id"`
+				} `json:"key"`
+				DocCount int `json:"doc_count"`
+			} `json:"buckets"`
+		} `json:"orgs"`
+	} `json:"aggregations"`
+}
+
+// counts the documents in the given index by org, paging through a composite aggregation
+func (i *baseIndexer) countDocsByOrg(ctx context.Context, index string) (map[int64]int, error) {
+	counts := make(map[int64]int)
+	var after any
+
+	for {
+		composite := map[string]any{
+			"size":    1000,
+			"sources": []any{map[string]any{"org_id": map[string]any{"terms": map[string]any{"field": "org_id"}}}},
+		}
+		if after != nil {
+			composite["after"] = after
+		}
+
+		search := map[string]any{"size": 0, "track_total_hits": false, "aggs": map[string]any{"orgs": map[string]any{"composite": composite}}}
+
+		response := &orgCountsResponse{}
+		_, err := utils.MakeJSONRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/_search", i.elasticURL, index), jsonx.MustMarshal(search), response)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range response.Aggregations.Orgs.Buckets {
+			counts[b.Key.OrgID] = b.DocCount
+		}
+
+		if response.Aggregations.Orgs.AfterKey == nil || len(response.Aggregations.Orgs.Buckets) == 0 {
+			return counts, nil
+		}
+		after = response.Aggregations.Orgs.AfterKey
+	}
+}
+
+// returns whether an actual count is within the given fractional tolerance of an expected count, rounding the
+// allowed difference up so that small counts aren't held to an exact match by a non-zero tolerance
+func withinTolerance(actual, expected int, tolerance float64) bool {
+	allowed := int(math.Ceil(float64(expected) * tolerance))
+	diff := actual - expected
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= allowed
+}
+
 // our response for indexing contacts
 type indexResponse struct {
 	Items []struct {
@@ -267,45 +598,58 @@ type indexResponse struct {
 	} `json:"items"`
 }
 
+// the outcome of indexing a batch
+type batchResult struct {
+	created  int // documents created
+	updated  int // documents updated
+	deleted  int // documents deleted
+	rejected int // documents rejected because ES was too busy
+}
+
 // indexes the batch of contacts
-func (i *baseIndexer) indexBatch(ctx context.Context, index string, batch []byte) (int, int, int, error) {
+func (i *baseIndexer) indexBatch(ctx context.Context, index string, batch []byte) (batchResult, error) {
 	response := indexResponse{}
 	indexURL := fmt.Sprintf("%s/%s/_bulk", i.elasticURL, index)
 
 	_, err := utils.MakeJSONRequest(ctx, http.MethodPut, indexURL, batch, &response)
 	if err != nil {
-		return 0, 0, 0, err
+		return batchResult{}, err
 	}
 
-	createdCount, updatedCount, deletedCount, conflictedCount := 0, 0, 0, 0
+	result := batchResult{}
+	conflictedCount := 0
 
 	for _, item := range response.Items {
 		if item.Index.ID != "" {
 			slog.Debug("index response", "id", item.Index.ID, "status", item.Index.Status)
 			if item.Index.Status == 200 {
-				updatedCount++
+				result.updated++
 			} else if item.Index.Status == 201 {
-				createdCount++
+				result.created++
 			} else if item.Index.Status == 409 {
 				conflictedCount++
+			} else if item.Index.Status == http.StatusTooManyRequests {
+				result.rejected++
 			} else {
 				slog.Error("error indexing document", "id", item.Index.ID, "status", item.Index.Status, "result", item.Index.Result)
 			}
 		} else if item.Delete.ID != "" {
 			slog.Debug("delete response", "id", item.Index.ID, "status", item.Index.Status)
 			if item.Delete.Status == 200 {
-				deletedCount++
+				result.deleted++
 			} else if item.Delete.Status == 409 {
 				conflictedCount++
+			} else if item.Delete.Status == http.StatusTooManyRequests {
+				result.rejected++
 			}
 		} else {
 			slog.Error("unparsed item in response")
 		}
 	}
 
-	slog.Debug("indexed batch", "created", createdCount, "updated", updatedCount, "deleted", deletedCount, "conflicted", conflictedCount)
+	slog.Debug("indexed batch", "created", result.created, "updated", result.updated, "deleted", result.deleted, "conflicted", conflictedCount, "rejected", result.rejected)
 
-	return createdCount, updatedCount, deletedCount, nil
+	return result, nil
 }
 
 // our response for finding the last modified document
@@ -325,15 +669,30 @@ type queryResponse struct {
 
 // GetESLastModified queries a concrete index and finds the last modified document, returning its modified time
 func (i *baseIndexer) GetESLastModified(ctx context.Context, index string) (time.Time, error) {
+	return i.findESLastModified(ctx, index, nil)
+}
+
+// finds the modified time of the last modified document in the given index that matches the given query, if any
+func (i *baseIndexer) findESLastModified(ctx context.Context, index string, query any) (time.Time, error) {
 	lastModified := time.Time{}
 
+	search := map[string]any{
+		"sort":             []any{map[string]any{"modified_on_mu": "desc"}},
+		"_source":          map[string]any{"includes": []string{"modified_on", "id"}},
+		"size":             1,
+		"track_total_hits": false,
+	}
+	if query != nil {
+		search["query"] = query
+	}
+
 	// get the newest document on our index
 	queryResponse := &queryResponse{}
 	_, err := utils.MakeJSONRequest(
 		ctx,
 		http.MethodPost,
 		fmt.Sprintf("%s/%s/_search", i.elasticURL, index),
-		[]byte(`{ "sort": [{ "modified_on_mu": "desc" }], "_source": {"includes": ["modified_on", "id"]}, "size": 1, "track_total_hits": false}`),
+		jsonx.MustMarshal(search),
 		queryResponse,
 	)
 	if err != nil {
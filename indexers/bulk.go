@@ -0,0 +1,212 @@
+package indexers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/nyaruka/rp-indexer/v10/utils"
+)
+
+const (
+	bulkInitialDocs   = 500             // number of documents per bulk request we start with
+	bulkMinDocs       = 10              // fewest documents per bulk request we'll shrink to
+	bulkTargetLatency = 2 * time.Second // latency we try to keep bulk requests under
+	bulkMaxAttempts   = 10              // number of times we'll try a bulk request that ES keeps rejecting
+)
+
+// bulkSizer decides how many documents go into each bulk request, capping requests by payload size, and adjusting
+// the number of documents based on how long requests are taking and whether ES is rejecting documents.
+type bulkSizer struct {
+	maxDocs  int
+	maxBytes int
+
+	mu   sync.Mutex
+	docs int
+}
+
+func newBulkSizer(maxDocs, maxBytes int) *bulkSizer {
+	return &bulkSizer{maxDocs: maxDocs, maxBytes: maxBytes, docs: min(bulkInitialDocs, maxDocs)}
+}
+
+// Docs returns the current number of documents to put in each bulk request
+func (s *bulkSizer) Docs() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.docs
+}
+
+// Fits returns whether a document of the given size can be added to a request of the given size
+func (s *bulkSizer) Fits(requestBytes, docBytes int) bool {
+	return requestBytes == 0 || s.maxBytes <= 0 || requestBytes+docBytes <= s.maxBytes
+}
+
+// Observe adjusts our number of documents after a bulk request, halving it if ES rejected any documents, shrinking
+// it if the request was slow, and growing it if the request was fast
+func (s *bulkSizer) Observe(docs int, latency time.Duration, rejected bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	prev := s.docs
+	floor := min(bulkMinDocs, s.maxDocs)
+
+	if rejected {
+		s.docs = max(s.docs/2, floor)
+	} else if latency > bulkTargetLatency {
+		s.docs = max(s.docs*3/4, floor)
+	} else if latency < bulkTargetLatency/2 && docs >= s.docs {
+		// only grow if this request was actually full, otherwise we've learned nothing about larger requests
+		s.docs = min(s.docs+max(s.docs/4, 1), s.maxDocs)
+	}
+
+	if s.docs != prev {
+		slog.Debug("adjusted bulk size", "from", prev, "to", s.docs, "latency", latency, "rejected", rejected)
+	}
+}
+
+// bulkSender sends bulk requests to an index using a pool of concurrent workers fed from a bounded queue, so
+// that callers can carry on fetching the next batch from the database while previous batches are being sent.
+type bulkSender struct {
+	indexer *baseIndexer
+	index   string
+	sizer   *bulkSizer
+	ctx     context.Context
+	cancel  context.CancelFunc
+	queue   chan bulkBatch
+	wg      sync.WaitGroup
+
+	mu      sync.Mutex
+	created int
+	updated int
+	deleted int
+	elapsed time.Duration // total time spent by workers in bulk requests
+	err     error
+}
+
+// a batch of documents to be sent as a single bulk request
+type bulkBatch struct {
+	body []byte
+	docs int
+}
+
+func (i *baseIndexer) newBulkSender(ctx context.Context, index string, workers int, sizer *bulkSizer) *bulkSender {
+	workers = max(workers, 1)
+	ctx, cancel := context.WithCancel(ctx)
+
+	s := &bulkSender{indexer: i, index: index, sizer: sizer, ctx: ctx, cancel: cancel, queue: make(chan bulkBatch, workers)}
+
+	for range workers {
+		s.wg.Go(s.work)
+	}
+
+	return s
+}
+
+func (s *bulkSender) work() {
+	for batch := range s.queue {
+		// if another worker has failed, just drain the queue
+		if s.ctx.Err() != nil {
+			continue
+		}
+
+		result, elapsed, err := s.send(batch)
+
+		s.mu.Lock()
+		if err != nil {
+			if s.err == nil {
+				s.err = err
+				s.cancel()
+			}
+		} else {
+			s.created += result.created
+			s.updated += result.updated
+			s.deleted += result.deleted
+			s.elapsed += elapsed
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sends a batch, waiting out any backpressure, and resending it if ES rejects it or any of its documents as too many,
+// which is safe because documents are versioned
+func (s *bulkSender) send(batch bulkBatch) (batchResult, time.Duration, error) {
+	total := batchResult{}
+	elapsed := time.Duration(0)
+
+	for range bulkMaxAttempts {
+		if err := s.indexer.pressure.Wait(s.ctx); err != nil {
+			return total, elapsed, err
+		}
+
+		start := time.Now()
+		result, err := s.indexer.indexBatch(s.ctx, s.index, batch.body)
+		took := time.Since(start)
+		elapsed += took
+
+		var throttled *utils.ThrottledError
+		if errors.As(err, &throttled) {
+			s.sizer.Observe(batch.docs, took, true)
+			s.indexer.pressure.Trip("bulk request rejected", throttled.RetryAfter)
+			continue
+		} else if err != nil {
+			return total, elapsed, err
+		}
+
+		s.sizer.Observe(batch.docs, took, result.rejected > 0)
+
+		total.created += result.created
+		total.updated += result.updated
+		total.deleted += result.deleted
+
+		if result.rejected > 0 {
+			s.indexer.pressure.Trip(fmt.Sprintf("%d documents rejected", result.rejected), 0)
+			continue
+		}
+
+		s.indexer.pressure.Reset()
+		return total, elapsed, nil
+	}
+
+	return total, elapsed, fmt.Errorf("bulk request still rejected after %d attempts", bulkMaxAttempts)
+}
+
+// Send queues the given batch, blocking while the queue is full, and returning an error if sending has failed
+func (s *bulkSender) Send(body []byte, docs int) error {
+	select {
+	case s.queue <- bulkBatch{body: body, docs: docs}:
+		return nil
+	case <-s.ctx.Done():
+		return s.Err()
+	}
+}
+
+// Err returns the error which stopped sending, if any
+func (s *bulkSender) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return s.err
+	}
+	return s.ctx.Err()
+}
+
+// Wait waits for all queued batches to be sent, returning the first error encountered if any
+func (s *bulkSender) Wait() error {
+	close(s.queue)
+	s.wg.Wait()
+
+	err := s.Err()
+	s.cancel()
+	return err
+}
+
+// Abort stops sending and waits for workers to exit
+func (s *bulkSender) Abort() {
+	s.cancel()
+	s.Wait()
+}
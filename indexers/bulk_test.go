@@ -0,0 +1,67 @@
+package indexers_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nyaruka/rp-indexer/v10/indexers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBulkSizerObserve(t *testing.T) {
+	// we start with 500 documents per request, unless our maximum is less than that
+	assert.Equal(t, 500, indexers.NewBulkSizer(5000, 10_000_000).Docs())
+	assert.Equal(t, 100, indexers.NewBulkSizer(100, 10_000_000).Docs())
+
+	tcs := []struct {
+		maxDocs  int
+		docs     int
+		sent     int
+		latency  time.Duration
+		rejected bool
+		expected int
+	}{
+		{maxDocs: 5000, docs: 500, sent: 500, latency: 100 * time.Millisecond, expected: 625},                 // fast and full grows by a quarter
+		{maxDocs: 5000, docs: 500, sent: 200, latency: 100 * time.Millisecond, expected: 500},                 // fast but not full doesn't grow
+		{maxDocs: 5000, docs: 500, sent: 500, latency: 1500 * time.Millisecond, expected: 500},                // near target latency is unchanged
+		{maxDocs: 5000, docs: 500, sent: 500, latency: 3 * time.Second, expected: 375},                        // slow shrinks by a quarter
+		{maxDocs: 5000, docs: 500, sent: 500, latency: 100 * time.Millisecond, rejected: true, expected: 250}, // rejections halve
+		{maxDocs: 5000, docs: 500, sent: 500, latency: 3 * time.Second, rejected: true, expected: 250},        // even if also slow
+		{maxDocs: 5000, docs: 12, sent: 12, latency: 3 * time.Second, expected: 10},                           // can't shrink below floor
+		{maxDocs: 5000, docs: 12, sent: 12, latency: 0, rejected: true, expected: 10},                         // even when rejected
+		{maxDocs: 5000, docs: 10, sent: 10, latency: 3 * time.Second, expected: 10},                           // already at floor
+		{maxDocs: 5, docs: 5, sent: 5, latency: 3 * time.Second, expected: 5},                                 // floor is our maximum if that's lower
+		{maxDocs: 5000, docs: 4900, sent: 4900, latency: 100 * time.Millisecond, expected: 5000},              // can't grow beyond maximum
+		{maxDocs: 5000, docs: 5000, sent: 5000, latency: 100 * time.Millisecond, expected: 5000},              // already at maximum
+		{maxDocs: 5, docs: 2, sent: 2, latency: 100 * time.Millisecond, expected: 3},                          // small sizes grow by at least 1
+	}
+
+	for _, tc := range tcs {
+		s := indexers.NewBulkSizerAt(tc.maxDocs, 10_000_000, tc.docs)
+		s.Observe(tc.sent, tc.latency, tc.rejected)
+
+		assert.Equal(t, tc.expected, s.Docs(), "docs mismatch for %+v", tc)
+	}
+}
+
+func TestBulkSizerFits(t *testing.T) {
+	tcs := []struct {
+		maxBytes     int
+		requestBytes int
+		docBytes     int
+		fits         bool
+	}{
+		{1000, 0, 400, true},
+		{1000, 500, 400, true},
+		{1000, 500, 500, true},
+		{1000, 500, 501, false},
+		{1000, 0, 5000, true}, // a document bigger than our maximum still goes in a request by itself
+		{0, 500, 5000, true},  // no maximum
+	}
+
+	for _, tc := range tcs {
+		s := indexers.NewBulkSizer(5000, tc.maxBytes)
+
+		assert.Equal(t, tc.fits, s.Fits(tc.requestBytes, tc.docBytes), "fits mismatch for %+v", tc)
+	}
+}
@@ -0,0 +1,152 @@
+package indexers
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/nyaruka/phonenumbers"
+)
+
+// ContactDoc is a contact document as indexed
+type ContactDoc struct {
+	ID             int64          `json:"id"`
+	OrgID          int64          `json:"org_id"`
+	UUID           string         `json:"uuid"`
+	Name           *string        `json:"name"`
+	Language       *string        `json:"language"`
+	Status         string         `json:"status"`
+	Tickets        int            `json:"tickets"`
+	IsActive       bool           `json:"is_active"`
+	CreatedOn      time.Time      `json:"created_on"`
+	ModifiedOn     time.Time      `json:"modified_on"`
+	ModifiedOnMu   int64          `json:"modified_on_mu"`
+	LastSeenOn     *time.Time     `json:"last_seen_on"`
+	URNs           []ContactURN   `json:"urns"`
+	Fields         []ContactField `json:"fields"`
+	GroupIDs       []int64        `json:"group_ids"`
+	FlowID         *int64         `json:"flow_id"`
+	FlowHistoryIDs []int64        `json:"flow_history_ids"`
+}
+
+// ContentHash returns a hash of the content of this document, ignoring when it was modified
+func (c *ContactDoc) ContentHash() uint64 {
+	content := *c
+	content.ModifiedOn = time.Time{}
+	content.ModifiedOnMu = 0
+	return hashJSON(&content)
+}
+
+// ContactURN is a URN of a contact document, where the highest priority URN of each scheme is preferred. Phone
+// numbers in international format are also indexed in E.164 format and as their national significant number, so
+// that they can be found by local formats and partial numbers.
+type ContactURN struct {
+	Scheme    string  `json:"scheme"`
+	Path      string  `json:"path"`
+	E164      string  `json:"e164,omitempty"`
+	National  string  `json:"national,omitempty"`
+	Display   *string `json:"display,omitempty"`
+	Priority  int     `json:"priority"`
+	ChannelID *int64  `json:"channel_id,omitempty"`
+	Preferred bool    `json:"preferred"`
+}
+
+// NewContactURN creates a new URN of a contact document
+func NewContactURN(scheme, path string) ContactURN {
+	u := ContactURN{Scheme: scheme, Path: path}
+
+	if scheme == "tel" && strings.HasPrefix(path, "+") {
+		if num, err := phonenumbers.Parse(path, ""); err == nil && phonenumbers.IsPossibleNumber(num) {
+			u.E164 = phonenumbers.Format(num, phonenumbers.E164)
+			u.National = phonenumbers.GetNationalSignificantNumber(num)
+		}
+	}
+
+	return u
+}
+
+// ContactField is a field value of a contact document, with the key and value type of its field. Location values
+// also get a keyword of just their last level, e.g. "King" for "USA > Washington > King", so that they can be
+// matched exactly.
+type ContactField struct {
+	Field           string      `json:"field"`
+	Key             string      `json:"key,omitempty"`
+	Type            string      `json:"type,omitempty"`
+	Text            string      `json:"text,omitempty"`
+	Number          json.Number `json:"number,omitempty"`
+	Datetime        string      `json:"datetime,omitempty"`
+	State           string      `json:"state,omitempty"`
+	StateKeyword    string      `json:"state_keyword,omitempty"`
+	District        string      `json:"district,omitempty"`
+	DistrictKeyword string      `json:"district_keyword,omitempty"`
+	Ward            string      `json:"ward,omitempty"`
+	WardKeyword     string      `json:"ward_keyword,omitempty"`
+}
+
+// ParseContactFields parses the fields JSON of a contact, which is an object of field values keyed by field UUID,
+// into the field values of a contact document, ordered by field UUID. Each field value is decoded on its own so that
+// values which don't have the expected types are dropped rather than failing the contact, and descriptions of those
+// are returned.
+func ParseContactFields(data []byte) ([]ContactField, []string) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(data, &values); err != nil {
+		return nil, []string{"fields aren't a JSON object"}
+	}
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	fields := make([]ContactField, 0, len(values))
+	var problems []string
+
+	for key, raw := range values {
+		var props map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &props); err != nil {
+			problems = append(problems, fmt.Sprintf("field %s value isn't a JSON object", key))
+			continue
+		}
+
+		f := ContactField{Field: key}
+
+		for prop, dest := range map[string]*string{"text": &f.Text, "datetime": &f.Datetime, "state": &f.State, "district": &f.District, "ward": &f.Ward} {
+			if v, ok := props[prop]; ok && !decodeFieldProp(v, dest) {
+				problems = append(problems, fmt.Sprintf("field %s %s isn't a string", key, prop))
+			}
+		}
+		if v, ok := props["number"]; ok && !decodeFieldProp(v, &f.Number) {
+			problems = append(problems, fmt.Sprintf("field %s number isn't a number", key))
+		}
+
+		f.StateKeyword = locationKeyword(f.State)
+		f.DistrictKeyword = locationKeyword(f.District)
+		f.WardKeyword = locationKeyword(f.Ward)
+
+		fields = append(fields, f)
+	}
+
+	slices.SortFunc(fields, func(a, b ContactField) int { return strings.Compare(a.Field, b.Field) })
+	slices.Sort(problems)
+
+	return fields, problems
+}
+
+// decodes a property of a field value into the given destination, leaving it empty if it has the wrong type
+func decodeFieldProp[T any](raw json.RawMessage, dest *T) bool {
+	var v T
+	if err := json.Unmarshal(raw, &v); err != nil {
+		return false
+	}
+	*dest = v
+	return true
+}
+
+// gets the last level of a location path, e.g. "King" for "USA > Washington > King"
+func locationKeyword(path string) string {
+	return strings.TrimSpace(path[strings.LastIndex(path, ">")+1:])
+}
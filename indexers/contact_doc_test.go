@@ -0,0 +1,130 @@
+package indexers_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/rp-indexer/v10/indexers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseContactFields(t *testing.T) {
+	fields, problems := indexers.ParseContactFields(nil)
+	assert.Nil(t, problems)
+	assert.Nil(t, fields)
+
+	fields, problems = indexers.ParseContactFields([]byte(`{}`))
+	assert.Nil(t, problems)
+	assert.Nil(t, fields)
+
+	fields, problems = indexers.ParseContactFields([]byte(`[]`))
+	assert.Equal(t, []string{"fields aren't a JSON object"}, problems)
+	assert.Nil(t, fields)
+
+	fields, problems = indexers.ParseContactFields([]byte(`{
+		"fcab2439-861c-4832-aa54-0c97f38f24ab": {"text": "USA > Washington > King-Côunty", "district": "USA > Washington > King-Côunty"},
+		"05bca1cd-e322-4837-9595-86d0d85e5adb": {"text": "88888888888888888888888888", "number": 88888888888888888888888888},
+		"a551ade4-e5a0-4d83-b185-53b515ad2f2a": {"text": "USA > Washington > King-Côunty > Central District", "ward": "USA > Washington > King-Côunty > Central District"},
+		"22d11697-edba-4186-b084-793e3b876379": {"text": "Colorado", "state": "Colorado"},
+		"e0eac267-463a-4c00-9732-cab62df07b16": {"text": "2018-04-06T18:37:59+00:00", "datetime": "2018-04-06T18:37:59+00:00"}
+	}`))
+	assert.Nil(t, problems)
+	assert.Equal(t, []indexers.ContactField{
+		{Field: "05bca1cd-e322-4837-9595-86d0d85e5adb", Text: "88888888888888888888888888", Number: "88888888888888888888888888"},
+		{Field: "22d11697-edba-4186-b084-793e3b876379", Text: "Colorado", State: "Colorado", StateKeyword: "Colorado"},
+		{Field: "a551ade4-e5a0-4d83-b185-53b515ad2f2a", Text: "USA > Washington > King-Côunty > Central District", Ward: "USA > Washington > King-Côunty > Central District", WardKeyword: "Central District"},
+		{Field: "e0eac267-463a-4c00-9732-cab62df07b16", Text: "2018-04-06T18:37:59+00:00", Datetime: "2018-04-06T18:37:59+00:00"},
+		{Field: "fcab2439-861c-4832-aa54-0c97f38f24ab", Text: "USA > Washington > King-Côunty", District: "USA > Washington > King-Côunty", DistrictKeyword: "King-Côunty"},
+	}, fields)
+
+	// values with unexpected types are dropped rather than failing the contact
+	fields, problems = indexers.ParseContactFields([]byte(`{
+		"05bca1cd-e322-4837-9595-86d0d85e5adb": {"text": 123},
+		"22d11697-edba-4186-b084-793e3b876379": {"text": "x", "number": "abc"},
+		"a551ade4-e5a0-4d83-b185-53b515ad2f2a": "oops",
+		"e0eac267-463a-4c00-9732-cab62df07b16": {"text": "12", "number": "12", "state": null}
+	}`))
+	assert.Equal(t, []string{
+		"field 05bca1cd-e322-4837-9595-86d0d85e5adb text isn't a string",
+		"field 22d11697-edba-4186-b084-793e3b876379 number isn't a number",
+		"field a551ade4-e5a0-4d83-b185-53b515ad2f2a value isn't a JSON object",
+	}, problems)
+	assert.Equal(t, []indexers.ContactField{
+		{Field: "05bca1cd-e322-4837-9595-86d0d85e5adb"},
+		{Field: "22d11697-edba-4186-b084-793e3b876379", Text: "x"},
+		{Field: "e0eac267-463a-4c00-9732-cab62df07b16", Text: "12", Number: "12"},
+	}, fields)
+}
+
+func TestContactDocJSON(t *testing.T) {
+	name := "Joanne Stone"
+	lastSeenOn := time.Date(2020, 8, 4, 21, 0, 0, 0, time.UTC)
+	modifiedOn := time.Date(2017, 11, 10, 21, 11, 59, 890662000, time.UTC)
+
+	fields, problems := indexers.ParseContactFields([]byte(`{"22d11697-edba-4186-b084-793e3b876379": {"text": "USA > Colorado", "state": "USA > Colorado"}}`))
+	require.Nil(t, problems)
+
+	doc := &indexers.ContactDoc{
+		ID:           6,
+		OrgID:        2,
+		UUID:         "7051dff0-0a27-49d7-af1f-4494239139e6",
+		Name:         &name,
+		Status:       "A",
+		IsActive:     true,
+		CreatedOn:    modifiedOn,
+		ModifiedOn:   modifiedOn,
+		ModifiedOnMu: modifiedOn.UnixMicro(),
+		LastSeenOn:   &lastSeenOn,
+		URNs:         []indexers.ContactURN{{Scheme: "tel", Path: "+12067798888"}},
+		Fields:       fields,
+	}
+
+	data, err := json.Marshal(doc)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"id": 6,
+		"org_id": 2,
+		"uuid": "7051dff0-0a27-49d7-af1f-4494239139e6",
+		"name": "Joanne Stone",
+		"language": null,
+		"status": "A",
+		"tickets": 0,
+		"is_active": true,
+		"created_on": "2017-11-10T21:11:59.890662Z",
+		"modified_on": "2017-11-10T21:11:59.890662Z",
+		"modified_on_mu": 1510348319890662,
+		"last_seen_on": "2020-08-04T21:00:00Z",
+		"urns": [{"scheme": "tel", "path": "+12067798888", "priority": 0, "preferred": false}],
+		"fields": [{"field": "22d11697-edba-4186-b084-793e3b876379", "text": "USA > Colorado", "state": "USA > Colorado", "state_keyword": "Colorado"}],
+		"group_ids": null,
+		"flow_id": null,
+		"flow_history_ids": null
+	}`, string(data))
+}
+
+func TestContactDocContentHash(t *testing.T) {
+	name := "Bob"
+	doc1 := &indexers.ContactDoc{ID: 1, Name: &name, ModifiedOn: time.Date(2017, 11, 10, 21, 11, 59, 0, time.UTC), ModifiedOnMu: 1510348319000000}
+	doc2 := &indexers.ContactDoc{ID: 1, Name: &name, ModifiedOn: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), ModifiedOnMu: 1577836800000000}
+	doc3 := &indexers.ContactDoc{ID: 1, Name: &name, GroupIDs: []int64{4}}
+
+	// modified time is ignored
+	assert.Equal(t, doc1.ContentHash(), doc2.ContentHash())
+	assert.NotEqual(t, doc1.ContentHash(), doc3.ContentHash())
+	assert.Equal(t, time.Date(2017, 11, 10, 21, 11, 59, 0, time.UTC), doc1.ModifiedOn)
+}
+
+func TestNewContactURN(t *testing.T) {
+	assert.Equal(t, indexers.ContactURN{Scheme: "tel", Path: "+12067791111", E164: "+12067791111", National: "2067791111"}, indexers.NewContactURN("tel", "+12067791111"))
+	assert.Equal(t, indexers.ContactURN{Scheme: "tel", Path: "+250788383383", E164: "+250788383383", National: "788383383"}, indexers.NewContactURN("tel", "+250788383383"))
+
+	// numbers not in international format, or which aren't possible numbers, aren't normalized
+	assert.Equal(t, indexers.ContactURN{Scheme: "tel", Path: "0788383383"}, indexers.NewContactURN("tel", "0788383383"))
+	assert.Equal(t, indexers.ContactURN{Scheme: "tel", Path: "+12"}, indexers.NewContactURN("tel", "+12"))
+	assert.Equal(t, indexers.ContactURN{Scheme: "tel", Path: "+1abc"}, indexers.NewContactURN("tel", "+1abc"))
+
+	// nor are URNs of other schemes
+	assert.Equal(t, indexers.ContactURN{Scheme: "whatsapp", Path: "12067791111"}, indexers.NewContactURN("whatsapp", "12067791111"))
+}
@@ -1,14 +1,21 @@
 package indexers
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
 	_ "embed"
 	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/lib/pq"
+	"github.com/nyaruka/gocommon/jsonx"
 	"github.com/nyaruka/rp-indexer/v10/runtime"
+	"github.com/nyaruka/rp-indexer/v10/utils"
+	"github.com/nyaruka/rp-indexer/v10/watermarks"
 )
 
 //go:embed contacts.index.json
@@ -18,24 +25,62 @@ var contactsIndexDef []byte
 type ContactIndexer struct {
 	baseIndexer
 
-	batchSize int
+	watermarkIndex string                  // the physical index our watermarks are for
+	watermarks     map[partition]time.Time // last modified time of what we've indexed, by partition
 }
 
-// NewContactIndexer creates a new contact indexer
-func NewContactIndexer(elasticURL, name string, shards, replicas, batchSize int) *ContactIndexer {
+// NewContactIndexer creates a new contact indexer, whose bulk requests are adaptively sized up to the given maximum
+// number of documents and bytes
+func NewContactIndexer(elasticURL, name string, shards, replicas, maxBatchDocs, maxBatchBytes int) *ContactIndexer {
 	def := newIndexDefinition(contactsIndexDef, shards, replicas)
 
 	return &ContactIndexer{
-		baseIndexer: newBaseIndexer(elasticURL, name, def),
-		batchSize:   batchSize,
+		baseIndexer: newBaseIndexer(elasticURL, name, def, maxBatchDocs, maxBatchBytes),
 	}
 }
 
-// Index indexes modified contacts and returns the name of the concrete index
-func (i *ContactIndexer) Index(rt *runtime.Runtime, rebuild, cleanup bool) (string, error) {
-	ctx := context.TODO()
+// Index indexes modified contacts and returns the name of the concrete index. If the context is cancelled, indexing
+// stops as soon as in-flight database queries and bulk requests are aborted.
+func (i *ContactIndexer) Index(ctx context.Context, rt *runtime.Runtime, rebuild, cleanup bool) (string, error) {
 	var err error
 
+	// if partitioning, only index the partitions we own, unless rebuilding which always indexes everything
+	partitions := []partition{{}}
+	if !rebuild {
+		partitions, err = parsePartitions(rt.Config.ContactsPartitionsOwned, rt.Config.ContactsPartitions)
+		if err != nil {
+			return "", fmt.Errorf("error parsing owned partitions: %w", err)
+		}
+	}
+
+	// if configured, remember content hashes so we can skip contacts that haven't really changed
+	if i.hashes == nil && rt.Config.ContactsHashCache > 0 {
+		i.hashes = newHashCache(rt.Config.ContactsHashCache)
+	}
+
+	// don't start if the cluster is struggling
+	if err := i.pressure.Wait(ctx); err != nil {
+		return "", fmt.Errorf("error waiting for cluster: %w", err)
+	}
+
+	// only one process can rebuild at a time, otherwise they'd both resume the same index and write into it
+	if rebuild {
+		lock := utils.NewLock(rt.DB, "rebuild:"+i.name)
+		held, err := lock.Acquire(ctx)
+		if err != nil {
+			return "", fmt.Errorf("error acquiring rebuild lock: %w", err)
+		}
+		if !held {
+			return "", fmt.Errorf("another rebuild of %s is already in progress", i.name)
+		}
+
+		defer func() {
+			if err := lock.Release(context.WithoutCancel(ctx)); err != nil {
+				i.log().Error("error releasing rebuild lock", "error", err)
+			}
+		}()
+	}
+
 	// find our physical index
 	physicalIndexes := i.FindIndexes(ctx)
 
@@ -47,9 +92,31 @@ func (i *ContactIndexer) Index(rt *runtime.Runtime, rebuild, cleanup bool) (stri
 	// whether we need to remap our alias after building
 	remapAlias := false
 
+	// if we are rebuilding, look for a previous rebuild that was interrupted and resume it
+	var resumed *rebuildProgress
+	if rebuild {
+		physicalIndex, resumed, err = i.findResumableRebuild(ctx)
+		if err != nil {
+			return "", fmt.Errorf("error finding resumable rebuild: %w", err)
+		}
+		if physicalIndex != "" {
+			i.log().Info("resuming rebuild", "index", physicalIndex, "started_on", resumed.StartedOn, "last_modified", resumed.LastModified)
+
+			// pick up from where it got to
+			i.watermarkIndex = physicalIndex
+			i.watermarks = map[partition]time.Time{{}: resumed.LastModified}
+		}
+		remapAlias = true
+	}
+
 	// doesn't exist or we are rebuilding, create it
-	if physicalIndex == "" || rebuild {
-		physicalIndex, err = i.createNewIndex(ctx, i.definition)
+	if physicalIndex == "" {
+		def := i.definition
+		if rebuild && rt.Config.RebuildOptimize {
+			def = def.forBulkLoading()
+		}
+
+		physicalIndex, err = i.createNewIndex(ctx, def)
 		if err != nil {
 			return "", fmt.Errorf("error creating new index: %w", err)
 		}
@@ -57,17 +124,55 @@ func (i *ContactIndexer) Index(rt *runtime.Runtime, rebuild, cleanup bool) (stri
 		remapAlias = true
 	}
 
-	lastModified, err := i.GetESLastModified(ctx, physicalIndex)
-	if err != nil {
-		return "", fmt.Errorf("error finding last modified: %w", err)
+	if rebuild {
+		if err := i.startRebuild(ctx, physicalIndex, resumed, rt.Config.RebuildOptimize); err != nil {
+			return "", err
+		}
+	} else {
+		// warn if the index needs rebuilt to use our current definition
+		if err := i.checkDefinition(ctx, physicalIndex); err != nil {
+			return "", err
+		}
 	}
 
-	i.log().Debug("indexing newer than last modified", "index", physicalIndex, "last_modified", lastModified)
+	// if we're reading from a replica, contacts modified before our watermark may only just have become visible
+	lag, err := utils.ReplicationLag(ctx, rt.DB)
+	if err != nil {
+		return "", fmt.Errorf("error checking replication lag: %w", err)
+	}
+	if lag > 0 {
+		i.log().Debug("database is lagging", "lag", lag)
+	}
 
 	// now index our docs
-	err = i.indexModified(ctx, rt.DB, physicalIndex, lastModified.Add(-5*time.Second), rebuild)
-	if err != nil {
-		return "", fmt.Errorf("error indexing documents: %w", err)
+	for _, p := range partitions {
+		if err := i.indexPartition(ctx, rt, physicalIndex, p, rebuild, indexLookback+lag); err != nil {
+			return "", fmt.Errorf("error indexing documents: %w", err)
+		}
+	}
+
+	// we've only reached as far as our furthest behind partition
+	reached := i.watermarks[partitions[0]]
+	for _, p := range partitions[1:] {
+		if i.watermarks[p].Before(reached) {
+			reached = i.watermarks[p]
+		}
+	}
+	i.stats.LastModified = reached
+
+	// if we're rebuilding an index created with bulk loading settings, restore the regular settings before we switch to it
+	if rebuild && i.rebuildProgress.Optimized {
+		if err := i.restoreIndexSettings(ctx, physicalIndex, rt.Config.RebuildForceMerge, time.Duration(rt.Config.RebuildReplicasTimeout)*time.Second); err != nil {
+			return "", fmt.Errorf("error restoring settings of rebuilt index: %w", err)
+		}
+	}
+
+	// if we're rebuilding, check the new index is good before we switch to it
+	if rebuild && rt.Config.RebuildValidate {
+		if err := i.validateRebuild(ctx, rt.DB, physicalIndex, rt.Config.RebuildTolerance, rt.Config.RebuildValidateOrgs, time.Duration(rt.Config.RebuildGreenTimeout)*time.Second); err != nil {
+			i.abandonRebuild()
+			return "", fmt.Errorf("rebuilt index %s failed validation: %w", physicalIndex, err)
+		}
 	}
 
 	// if the index didn't previously exist or we are rebuilding, remap to our alias
@@ -77,11 +182,15 @@ func (i *ContactIndexer) Index(rt *runtime.Runtime, rebuild, cleanup bool) (stri
 			return "", fmt.Errorf("error updating alias: %w", err)
 		}
 		remapAlias = false
+
+		if err := i.endRebuild(ctx, rebuildStatusComplete); err != nil {
+			return "", err
+		}
 	}
 
 	// cleanup our aliases if appropriate
 	if cleanup {
-		err := i.cleanupIndexes(ctx)
+		err := i.cleanupIndexes(ctx, rt.Config.Retain, rt.Config.SnapshotRepository)
 		if err != nil {
 			return "", fmt.Errorf("error cleaning up old indexes: %w", err)
 		}
@@ -90,194 +199,446 @@ func (i *ContactIndexer) Index(rt *runtime.Runtime, rebuild, cleanup bool) (stri
 	return physicalIndex, nil
 }
 
-const sqlSelectModifiedContacts = `
-SELECT org_id, id, modified_on, is_active, row_to_json(t) FROM (
-	SELECT
-		id,
-		org_id,
-		uuid,
-		name,
-		language,
-		status,
-		ticket_count AS tickets,
-		is_active,
-		created_on,
-		modified_on,
-		last_seen_on,
-		EXTRACT(EPOCH FROM modified_on) * 1000000 AS modified_on_mu,
-		(
-			SELECT array_to_json(array_agg(row_to_json(u)))
-			FROM (SELECT scheme, path FROM contacts_contacturn WHERE contact_id = contacts_contact.id) u
-		) AS urns,
-		(
-			SELECT jsonb_agg(f.value)
-			FROM (
-				SELECT 
-					CASE
-					WHEN value ? 'ward'
-					THEN jsonb_build_object('ward_keyword', trim(substring(value ->> 'ward' from  '(?!.* > )([^>]+)')))
-					ELSE '{}'::jsonb
-					END || district_value.value AS value
-				FROM (
-					SELECT 
-						CASE
-						WHEN value ? 'district'
-						THEN jsonb_build_object('district_keyword', trim(substring(value ->> 'district' from  '(?!.* > )([^>]+)')))
-						ELSE '{}'::jsonb
-						END || state_value.value as value
-					FROM (
-						SELECT 
-							CASE
-							WHEN value ? 'state'
-							THEN jsonb_build_object('state_keyword', trim(substring(value ->> 'state' from  '(?!.* > )([^>]+)')))
-							ELSE '{}' :: jsonb
-							END || jsonb_build_object('field', key) || value as value
-						FROM jsonb_each(contacts_contact.fields)
-					) state_value
-				) AS district_value
-			) AS f
-		) AS fields,
-		(
-			SELECT array_to_json(array_agg(gc.contactgroup_id)) 
-			FROM contacts_contactgroup_contacts gc 
-			INNER JOIN contacts_contactgroup g ON g.id = gc.contactgroup_id
-			WHERE gc.contact_id = contacts_contact.id AND g.group_type IN ('M', 'Q')
-		) AS group_ids,
-		current_flow_id AS flow_id,
-		(
-			SELECT array_to_json(array_agg(DISTINCT fr.flow_id)) FROM flows_flowrun fr WHERE fr.contact_id = contacts_contact.id
-		) AS flow_history_ids
-	FROM contacts_contact
-	WHERE modified_on >= $1
-	ORDER BY modified_on ASC
-	LIMIT 100000
-) t;
-`
-
-// IndexModified queries and indexes all contacts with a lastModified greater than or equal to the passed in time
-func (i *ContactIndexer) indexModified(ctx context.Context, db *sql.DB, index string, lastModified time.Time, rebuild bool) error {
-	totalFetched, totalCreated, totalUpdated, totalDeleted := 0, 0, 0, 0
-
-	var modifiedOn time.Time
-	var contactJSON string
-	var id, orgID int64
-	var isActive bool
-
-	subBatch := &bytes.Buffer{}
-	start := time.Now()
-
-	for {
-		batchStart := time.Now()        // start time for this batch
-		batchFetched := 0               // contacts fetched in this batch
-		batchCreated := 0               // contacts created in ES
-		batchUpdated := 0               // contacts updated in ES
-		batchDeleted := 0               // contacts deleted in ES
-		batchESTime := time.Duration(0) // time spent indexing for this batch
-
-		indexSubBatch := func(b *bytes.Buffer) error {
-			t := time.Now()
-			created, updated, deleted, err := i.indexBatch(ctx, index, b.Bytes())
-			if err != nil {
-				return err
-			}
+// indexes modified contacts in the given partition, using and updating our watermark for that partition. When not
+// rebuilding, that watermark is read from and saved to our watermark store if we have one. Contacts modified up to
+// lookback before the watermark are reindexed in case they weren't yet visible when we last indexed.
+func (i *ContactIndexer) indexPartition(ctx context.Context, rt *runtime.Runtime, index string, p partition, rebuild bool, lookback time.Duration) error {
+	// watermarks only apply to the physical index they were read from
+	if i.watermarkIndex != index {
+		i.watermarkIndex = index
+		i.watermarks = make(map[partition]time.Time)
+	}
+
+	var store watermarks.Store
+	if !rebuild {
+		store = rt.Watermarks
+	}
 
-			batchESTime += time.Since(t)
-			batchCreated += created
-			batchUpdated += updated
-			batchDeleted += deleted
-			b.Reset()
-			return nil
+	lastModified, found := i.watermarks[p]
+	if !found && store != nil {
+		watermark, err := store.Get(ctx, i.watermarkKey(p))
+		if err != nil {
+			return fmt.Errorf("error reading watermark: %w", err)
 		}
 
-		rows, err := db.QueryContext(ctx, sqlSelectModifiedContacts, lastModified)
+		// watermarks only apply to the physical index they were saved for
+		if watermark != nil && watermark.Index == index {
+			lastModified, found = watermark.ModifiedOn, true
+		}
+	}
+	if !found {
+		var err error
+		lastModified, err = i.findESLastModified(ctx, index, p.esQuery())
+		if err != nil {
+			return fmt.Errorf("error finding last modified: %w", err)
+		}
+	}
 
-		queryModified := lastModified
+	i.log().Debug("indexing newer than last modified", "index", index, "partition", p.num, "partitions", p.total, "last_modified", lastModified, "lookback", lookback)
 
-		// no more rows? return
-		if err == sql.ErrNoRows {
-			return nil
+	// after each batch, record how far we've got
+	progress := func(modifiedOn time.Time, id int64) error {
+		if rebuild {
+			return i.recordRebuildProgress(ctx, index, modifiedOn)
 		}
+		if store != nil && modifiedOn.After(lastModified) {
+			watermark := &watermarks.Watermark{Index: index, ModifiedOn: modifiedOn, ID: id, UpdatedOn: time.Now()}
+			if err := store.Set(ctx, i.watermarkKey(p), watermark); err != nil {
+				return fmt.Errorf("error saving watermark: %w", err)
+			}
+		}
+		return nil
+	}
+
+	fetch := i.fetchModified(rt.DB, p)
+
+	indexedModified, err := i.indexModified(ctx, index, lastModified.Add(-lookback), rebuild, rt.Config.ContactsBulkWorkers, fetch, progress)
+	if err != nil {
+		return err
+	}
+
+	if indexedModified.After(lastModified) {
+		lastModified = indexedModified
+	}
+	i.watermarks[p] = lastModified
+
+	return nil
+}
+
+// LockName returns the name of the leader lock for this indexer. If partitioning, this includes the partitions owned
+// by this instance, so only instances owning the same partitions compete for the same lock.
+func (i *ContactIndexer) LockName(cfg *runtime.Config) string {
+	partitions, err := parsePartitions(cfg.ContactsPartitionsOwned, cfg.ContactsPartitions)
+	if err != nil || cfg.ContactsPartitions <= 0 {
+		return i.name
+	}
+
+	nums := make([]string, len(partitions))
+	for n, p := range slices.SortedFunc(slices.Values(partitions), func(a, b partition) int { return a.num - b.num }) {
+		nums[n] = strconv.Itoa(p.num)
+	}
+
+	return fmt.Sprintf("%s:%s/%d", i.name, strings.Join(nums, ","), cfg.ContactsPartitions)
+}
+
+// the key of our watermark for the given partition
+func (i *ContactIndexer) watermarkKey(p partition) string {
+	if p.total == 0 {
+		return i.name
+	}
+	return fmt.Sprintf("%s:%d/%d", i.name, p.num, p.total)
+}
+
+// contacts are fetched in pages ordered by modified_on, and hydrated with their URNs, groups etc in smaller chunks
+const (
+	contactsPageSize  = 100000
+	contactsChunkSize = 1000
+)
+
+const sqlSelectModifiedContacts = `
+SELECT
+	id,
+	org_id,
+	uuid,
+	name,
+	language,
+	status,
+	ticket_count,
+	is_active,
+	created_on,
+	modified_on,
+	last_seen_on,
+	current_flow_id,
+	fields
+FROM contacts_contact
+WHERE modified_on >= $1 AND ($2 = 0 OR org_id % $2 = $3)
+ORDER BY modified_on ASC
+LIMIT $4`
+
+const sqlSelectContactFields = `
+SELECT uuid, org_id, key, value_type
+FROM contacts_contactfield
+WHERE uuid = ANY($1::uuid[]) AND is_active`
+
+// contact field UUIDs in the canonical form that postgres returns them in, so that malformed keys in contact JSON
+// aren't cast to uuid in queries where they'd cause an error
+var contactFieldUUIDRegex = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+const sqlSelectContactURNs = `
+SELECT contact_id, scheme, path, display, priority, channel_id
+FROM contacts_contacturn
+WHERE contact_id = ANY($1)
+ORDER BY contact_id, priority DESC, id`
+
+const sqlSelectContactGroups = `
+SELECT gc.contact_id, gc.contactgroup_id
+FROM contacts_contactgroup_contacts gc
+INNER JOIN contacts_contactgroup g ON g.id = gc.contactgroup_id
+WHERE gc.contact_id = ANY($1) AND g.group_type IN ('M', 'Q')
+ORDER BY gc.contact_id, gc.contactgroup_id`
+
+const sqlSelectContactFlowHistory = `
+SELECT DISTINCT contact_id, flow_id
+FROM flows_flowrun
+WHERE contact_id = ANY($1) AND flow_id IS NOT NULL
+ORDER BY contact_id, flow_id`
+
+// returns a fetch func for modified contacts in the given partition. Each page of contacts is read first, and then
+// their URNs, groups and flow history are loaded a chunk at a time with set based queries and added in Go, which
+// avoids running correlated subqueries for every contact.
+func (i *ContactIndexer) fetchModified(db *sql.DB, p partition) fetchFunc {
+	return func(ctx context.Context, lastModified time.Time, each func(*document) error) error {
+		rows, err := db.QueryContext(ctx, sqlSelectModifiedContacts, lastModified, p.total, p.num, contactsPageSize)
 		if err != nil {
 			return err
 		}
 		defer rows.Close()
 
+		chunk := make([]*ContactDoc, 0, contactsChunkSize)
+		invalid := make(map[int64][]string)
+
+		var fields []byte
+
 		for rows.Next() {
-			err = rows.Scan(&orgID, &id, &modifiedOn, &isActive, &contactJSON)
+			c := &ContactDoc{}
+			err := rows.Scan(&c.ID, &c.OrgID, &c.UUID, &c.Name, &c.Language, &c.Status, &c.Tickets, &c.IsActive, &c.CreatedOn, &c.ModifiedOn, &c.LastSeenOn, &c.FlowID, &fields)
 			if err != nil {
 				return err
 			}
+			c.ModifiedOnMu = c.ModifiedOn.UnixMicro()
 
-			batchFetched++
-			lastModified = modifiedOn
+			if c.IsActive {
+				var problems []string
+				c.Fields, problems = ParseContactFields(fields)
+				if len(problems) > 0 {
+					invalid[c.ID] = problems
+				}
+			}
 
-			if isActive {
-				i.log().Debug("modified contact", "id", id, "modifiedOn", modifiedOn, "contact", contactJSON)
+			chunk = append(chunk, c)
 
-				subBatch.WriteString(fmt.Sprintf(indexCommand, id, modifiedOn.UnixNano(), orgID))
-				subBatch.WriteString("\n")
-				subBatch.WriteString(contactJSON)
-				subBatch.WriteString("\n")
-			} else {
-				i.log().Debug("deleted contact", "id", id, "modifiedOn", modifiedOn)
+			if len(chunk) == contactsChunkSize {
+				if err := i.emitContacts(ctx, db, chunk, invalid, each); err != nil {
+					return err
+				}
+				chunk = make([]*ContactDoc, 0, contactsChunkSize)
+				invalid = make(map[int64][]string)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		return i.emitContacts(ctx, db, chunk, invalid, each)
+	}
+}
+
+// hydrates and sanitizes the given chunk of contacts and passes them as documents to the given func, along with the
+// given descriptions of invalid field values which were dropped when parsing them
+func (i *ContactIndexer) emitContacts(ctx context.Context, db *sql.DB, chunk []*ContactDoc, invalid map[int64][]string, each func(*document) error) error {
+	dropped, err := hydrateContacts(ctx, db, chunk)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chunk {
+		d := &document{ID: c.ID, OrgID: c.OrgID, ModifiedOn: c.ModifiedOn, IsActive: c.IsActive}
+		if c.IsActive {
+			d.Sanitized = slices.Concat(invalid[c.ID], dropped[c.ID], c.Sanitize())
+			d.Source = jsonx.MustMarshal(c)
+			d.Hash = c.ContentHash()
+		}
+		if err := each(d); err != nil {
+			return err
+		}
+	}
 
-				subBatch.WriteString(fmt.Sprintf(deleteCommand, id, modifiedOn.UnixNano(), orgID))
-				subBatch.WriteString("\n")
+	return nil
+}
+
+// loads the field definitions, URNs, groups and flow history of the active contacts in the given chunk, returning
+// descriptions of any field values dropped because their keys aren't valid field UUIDs, by contact id
+func hydrateContacts(ctx context.Context, db *sql.DB, chunk []*ContactDoc) (map[int64][]string, error) {
+	byID := make(map[int64]*ContactDoc, len(chunk))
+	ids := make([]int64, 0, len(chunk))
+	for _, c := range chunk {
+		if c.IsActive {
+			byID[c.ID] = c
+			ids = append(ids, c.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	dropped, err := loadContactFields(ctx, db, chunk)
+	if err != nil {
+		return nil, fmt.Errorf("error loading contact fields: %w", err)
+	}
+
+	err = queryByContact(ctx, db, sqlSelectContactURNs, ids, func(rows *sql.Rows) error {
+		var contactID int64
+		var scheme, path string
+		var display *string
+		var priority int
+		var channelID *int64
+		if err := rows.Scan(&contactID, &scheme, &path, &display, &priority, &channelID); err != nil {
+			return err
+		}
+
+		u := NewContactURN(scheme, path)
+		u.Display = display
+		u.Priority = priority
+		u.ChannelID = channelID
+
+		// URNs are ordered by priority so the first of each scheme is preferred
+		c := byID[contactID]
+		u.Preferred = !slices.ContainsFunc(c.URNs, func(o ContactURN) bool { return o.Scheme == scheme })
+
+		c.URNs = append(c.URNs, u)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading contact URNs: %w", err)
+	}
+
+	err = queryByContact(ctx, db, sqlSelectContactGroups, ids, func(rows *sql.Rows) error {
+		var contactID, groupID int64
+		if err := rows.Scan(&contactID, &groupID); err != nil {
+			return err
+		}
+		byID[contactID].GroupIDs = append(byID[contactID].GroupIDs, groupID)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading contact groups: %w", err)
+	}
+
+	err = queryByContact(ctx, db, sqlSelectContactFlowHistory, ids, func(rows *sql.Rows) error {
+		var contactID, flowID int64
+		if err := rows.Scan(&contactID, &flowID); err != nil {
+			return err
+		}
+		byID[contactID].FlowHistoryIDs = append(byID[contactID].FlowHistoryIDs, flowID)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error loading contact flow history: %w", err)
+	}
+
+	return dropped, nil
+}
+
+// the value types of contact fields and the names we index them with
+var contactFieldTypes = map[string]string{
+	"T": "text",
+	"N": "number",
+	"D": "datetime",
+	"S": "state",
+	"I": "district",
+	"W": "ward",
+}
+
+// adds the key and value type of the fields used by the active contacts in the given chunk, excluding the values of
+// fields which have been deleted or don't belong to the contact's org, and returning descriptions of values excluded
+// because their keys aren't valid field UUIDs by contact id
+func loadContactFields(ctx context.Context, db *sql.DB, chunk []*ContactDoc) (map[int64][]string, error) {
+	uuids := make([]string, 0, 10)
+	seen := make(map[string]bool)
+	for _, c := range chunk {
+		for _, f := range c.Fields {
+			if c.IsActive && !seen[f.Field] && contactFieldUUIDRegex.MatchString(f.Field) {
+				uuids = append(uuids, f.Field)
+				seen[f.Field] = true
 			}
+		}
+	}
+	type fieldDef struct {
+		orgID     int64
+		key       string
+		valueType string
+	}
 
-			// write to elastic search in batches
-			if batchFetched%i.batchSize == 0 {
-				if err := indexSubBatch(subBatch); err != nil {
-					return err
-				}
+	defs := make(map[string]fieldDef, len(uuids))
+
+	if len(uuids) > 0 {
+		rows, err := db.QueryContext(ctx, sqlSelectContactFields, pq.Array(uuids))
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var uuid string
+			var def fieldDef
+			if err := rows.Scan(&uuid, &def.orgID, &def.key, &def.valueType); err != nil {
+				return nil, err
 			}
+			defs[uuid] = def
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
 		}
+	}
 
-		if subBatch.Len() > 0 {
-			if err := indexSubBatch(subBatch); err != nil {
-				return err
+	dropped := make(map[int64][]string)
+
+	for _, c := range chunk {
+		fields := c.Fields[:0]
+		for _, f := range c.Fields {
+			if def, found := defs[f.Field]; found && def.orgID == c.OrgID {
+				f.Key = def.key
+				f.Type = contactFieldTypes[def.valueType]
+				fields = append(fields, f)
+			} else if !contactFieldUUIDRegex.MatchString(f.Field) {
+				dropped[c.ID] = append(dropped[c.ID], fmt.Sprintf("field key %s isn't a valid UUID", f.Field))
 			}
 		}
+		c.Fields = fields
+		if len(c.Fields) == 0 {
+			c.Fields = nil
+		}
+	}
 
-		rows.Close()
+	return dropped, nil
+}
 
-		totalFetched += batchFetched
-		totalCreated += batchCreated
-		totalUpdated += batchUpdated
-		totalDeleted += batchDeleted
+// runs a query which takes an array of contact ids, calling the given func for each row
+func queryByContact(ctx context.Context, db *sql.DB, query string, ids []int64, each func(*sql.Rows) error) error {
+	rows, err := db.QueryContext(ctx, query, pq.Array(ids))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-		totalTime := time.Since(start)
-		batchTime := time.Since(batchStart)
-		batchRate := int(float32(batchFetched) / (float32(batchTime) / float32(time.Second)))
+	for rows.Next() {
+		if err := each(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
 
-		log := i.log().With("index", index,
-			"rate", batchRate,
-			"batch_fetched", batchFetched,
-			"batch_created", batchCreated,
-			"batch_updated", batchUpdated,
-			"batch_elapsed", batchTime,
-			"batch_elapsed_es", batchESTime,
-			"total_fetched", totalFetched,
-			"total_created", totalCreated,
-			"total_updated", totalUpdated,
-			"total_elapsed", totalTime,
-		)
+// checks that a rebuilt index is healthy and has roughly as many documents as there are active contacts
+func (i *ContactIndexer) validateRebuild(ctx context.Context, db *sql.DB, index string, tolerance float64, byOrg bool, greenTimeout time.Duration) error {
+	if err := i.checkIndexHealth(ctx, index, greenTimeout); err != nil {
+		return err
+	}
 
-		// if we're rebuilding, always log batch progress
-		if rebuild {
-			log.Info("indexed contact batch")
-		} else {
-			log.Debug("indexed contact batch")
+	esCount, err := i.countDocs(ctx, index)
+	if err != nil {
+		return fmt.Errorf("error counting indexed contacts: %w", err)
+	}
+
+	var dbCount int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM contacts_contact WHERE is_active`).Scan(&dbCount); err != nil {
+		return fmt.Errorf("error counting active contacts: %w", err)
+	}
+
+	if !withinTolerance(esCount, dbCount, tolerance) {
+		return fmt.Errorf("index has %d documents but there are %d active contacts", esCount, dbCount)
+	}
+
+	if byOrg {
+		esCounts, err := i.countDocsByOrg(ctx, index)
+		if err != nil {
+			return fmt.Errorf("error counting indexed contacts by org: %w", err)
+		}
+
+		rows, err := db.QueryContext(ctx, `SELECT org_id, COUNT(*) FROM contacts_contact WHERE is_active GROUP BY org_id`)
+		if err != nil {
+			return fmt.Errorf("error counting active contacts by org: %w", err)
 		}
 
-		i.recordActivity(batchCreated+batchUpdated, batchDeleted, time.Since(batchStart))
+		defer rows.Close()
 
-		// last modified stayed the same and we didn't add anything, seen it all, break out
-		if lastModified.Equal(queryModified) && batchCreated == 0 {
-			break
+		dbCounts := make(map[int64]int)
+		for rows.Next() {
+			var orgID int64
+			var count int
+			if err := rows.Scan(&orgID, &count); err != nil {
+				return fmt.Errorf("error scanning contact count: %w", err)
+			}
+			dbCounts[orgID] = count
+		}
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("error counting active contacts by org: %w", err)
+		}
+
+		for orgID, dbCount := range dbCounts {
+			if !withinTolerance(esCounts[orgID], dbCount, tolerance) {
+				return fmt.Errorf("index has %d documents for org #%d but it has %d active contacts", esCounts[orgID], orgID, dbCount)
+			}
+		}
+		for orgID, esCount := range esCounts {
+			if _, found := dbCounts[orgID]; !found && !withinTolerance(esCount, 0, tolerance) {
+				return fmt.Errorf("index has %d documents for org #%d but it has no active contacts", esCount, orgID)
+			}
 		}
 	}
 
+	i.log().Info("validated rebuilt index", "index", index, "documents", esCount, "contacts", dbCount)
+
 	return nil
 }
 
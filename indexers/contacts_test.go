@@ -2,12 +2,18 @@ package indexers_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"path/filepath"
 	"testing"
 	"time"
 
 	"github.com/nyaruka/gocommon/elastic"
 	"github.com/nyaruka/rp-indexer/v10/indexers"
+	"github.com/nyaruka/rp-indexer/v10/runtime"
+	"github.com/nyaruka/rp-indexer/v10/utils"
+	"github.com/nyaruka/rp-indexer/v10/watermarks"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -47,6 +53,45 @@ var contactQueryTests = []struct {
 	{ // urn substring with more characters (600055)
 		elastic.Nested("urns", elastic.All(elastic.Match("urns.scheme", "tel"), elastic.MatchPhrase("urns.path", "600055"))), []int64{5},
 	},
+	{ // URN display
+		elastic.Nested("urns", elastic.Match("urns.display", "funguy")), []int64{8},
+	},
+	{ // URN display prefix
+		elastic.Nested("urns", elastic.Match("urns.display", "fung")), []int64{8, 9},
+	},
+	{ // URNs by channel
+		elastic.Nested("urns", elastic.Match("urns.channel_id", 3)), []int64{6},
+	},
+	{ // preferred URNs
+		elastic.Nested("urns", elastic.All(elastic.Match("urns.preferred", true), elastic.Term("urns.path.keyword", "+12067791111"))), []int64{1},
+	},
+	{ // a contact's second phone number isn't preferred
+		elastic.Nested("urns", elastic.All(elastic.Match("urns.preferred", true), elastic.Term("urns.path.keyword", "+12067792222"))), []int64{},
+	},
+	{ // non-preferred URNs
+		elastic.Nested("urns", elastic.All(elastic.Match("urns.preferred", false), elastic.Match("urns.scheme", "tel"))), []int64{1},
+	},
+	{ // phone number in E.164 format
+		elastic.Nested("urns", elastic.Term("urns.e164", "+12067798888")), []int64{6},
+	},
+	{ // phone number in local format
+		elastic.Nested("urns", elastic.Term("urns.national", "2067795555")), []int64{3},
+	},
+	{ // formatted phone number in local format
+		elastic.Nested("urns", elastic.Match("urns.national", "(206) 779-5555")), []int64{3},
+	},
+	{ // formatted phone number in local format with a trunk prefix
+		elastic.Nested("urns", elastic.Match("urns.national", "0206 779 5555")), []int64{3},
+	},
+	{ // formatted last digits of phone number
+		elastic.Nested("urns", elastic.Match("urns.national.suffix", "55-77")), []int64{5},
+	},
+	{ // last digits of phone number
+		elastic.Nested("urns", elastic.Match("urns.national.suffix", "5577")), []int64{5},
+	},
+	{ // last digits of phone number must be at least 4 digits
+		elastic.Nested("urns", elastic.Match("urns.national.suffix", "577")), []int64{},
+	},
 	{ // match a contact with multiple tel urns
 		elastic.Nested("urns", elastic.All(elastic.Match("urns.scheme", "tel"), elastic.MatchPhrase("urns.path", "222"))), []int64{1},
 	},
@@ -66,6 +111,21 @@ var contactQueryTests = []struct {
 		),
 		[]int64{2, 3, 4, 5, 6, 7, 8, 9},
 	},
+	{ // text field by key
+		elastic.Nested("fields", elastic.All(
+			elastic.Match("fields.key", "nickname"),
+			elastic.Match("fields.text", "the rock"),
+		)),
+		[]int64{1},
+	},
+	{ // values of deleted fields aren't indexed
+		elastic.Nested("fields", elastic.Match("fields.field", "f1b5aea6-6586-41c7-9020-1a6326cc6565")),
+		[]int64{},
+	},
+	{ // fields by value type
+		elastic.Nested("fields", elastic.Match("fields.type", "ward")),
+		[]int64{8},
+	},
 	{ // no tokenizing of field text
 		elastic.Nested("fields", elastic.All(
 			elastic.Match("fields.field", "17103bb1-1b48-4b70-92f7-1f6b73bd3488"),
@@ -157,6 +217,26 @@ var contactQueryTests = []struct {
 		)),
 		[]int64{},
 	},
+	{ // location paths match at any depth below the given location
+		elastic.Nested("fields", elastic.Any(
+			elastic.Match("fields.state.path", "USA > Washington"),
+			elastic.Match("fields.district.path", "USA > Washington"),
+			elastic.Match("fields.ward.path", "USA > Washington"),
+		)),
+		[]int64{5, 7, 8},
+	},
+	{
+		elastic.Nested("fields", elastic.Match("fields.ward.path", "usa>washington>king-côunty")),
+		[]int64{8},
+	},
+	{
+		elastic.Nested("fields", elastic.Match("fields.district.path", "USA > Colorado")),
+		[]int64{9},
+	},
+	{ // paths must start at the top level
+		elastic.Nested("fields", elastic.Match("fields.state.path", "Washington")),
+		[]int64{},
+	},
 	{elastic.Match("group_ids", 1), []int64{1}},
 	{elastic.Match("group_ids", 4), []int64{1, 2}},
 	{elastic.Match("group_ids", 2), []int64{}},
@@ -167,7 +247,7 @@ func TestContacts(t *testing.T) {
 	ctx := context.Background()
 	rt := setup(t)
 
-	ix1 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4)
+	ix1 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
 	assert.Equal(t, "indexer_test", ix1.Name())
 
 	dbModified, err := ix1.GetDBLastModified(context.Background(), rt.DB)
@@ -180,7 +260,7 @@ func TestContacts(t *testing.T) {
 
 	expectedIndexName := fmt.Sprintf("indexer_test_%s", time.Now().Format("2006_01_02"))
 
-	indexName, err := ix1.Index(rt, false, false)
+	indexName, err := ix1.Index(ctx, rt, false, false)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedIndexName, indexName)
 
@@ -191,12 +271,25 @@ func TestContacts(t *testing.T) {
 	assert.WithinDuration(t, time.Date(2017, 11, 10, 21, 11, 59, 890662000, time.UTC), esModified, 0)
 
 	assertIndexerStats(t, ix1, 9, 0)
+	assert.Equal(t, int64(2), ix1.Stats().Sanitized) // contact #4's huge number and #2's malformed field, but not #1's deleted field
 	assertIndexesWithPrefix(t, rt.Config, rt.Config.ContactsIndex, []string{expectedIndexName})
 
 	for _, tc := range contactQueryTests {
 		assertQuery(t, rt.Config, tc.query, tc.expected, "query mismatch for %s", tc.query)
 	}
 
+	// check a document has been hydrated with its URNs, groups and flow history
+	doc := elasticRequest(t, rt.Config, http.MethodGet, "/"+indexName+"/_doc/1?routing=1", nil)["_source"].(map[string]any)
+	assert.Equal(t, "c7a2dd87-a80e-420b-8431-ca48d422e924", doc["uuid"])
+	assert.Equal(t, json.Number("1510348319890662"), doc["modified_on_mu"])
+	assert.Equal(t, []any{
+		map[string]any{"scheme": "tel", "path": "+12067791111", "e164": "+12067791111", "national": "2067791111", "priority": json.Number("50"), "preferred": true},
+		map[string]any{"scheme": "tel", "path": "+12067792222", "e164": "+12067792222", "national": "2067792222", "priority": json.Number("40"), "preferred": false},
+	}, doc["urns"])
+	assert.Equal(t, []any{json.Number("1"), json.Number("4")}, doc["group_ids"])
+	assert.Equal(t, []any{json.Number("1"), json.Number("2")}, doc["flow_history_ids"])
+	assert.Nil(t, doc["flow_id"])
+
 	lastModified, err := ix1.GetESLastModified(ctx, indexName)
 	assert.NoError(t, err)
 	assert.Equal(t, time.Date(2017, 11, 10, 21, 11, 59, 890662000, time.UTC), lastModified.In(time.UTC))
@@ -209,7 +302,7 @@ func TestContacts(t *testing.T) {
 	require.NoError(t, err)
 
 	// and index again...
-	indexName, err = ix1.Index(rt, false, false)
+	indexName, err = ix1.Index(ctx, rt, false, false)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedIndexName, indexName) // same index used
 	assertIndexerStats(t, ix1, 10, 1)
@@ -229,10 +322,11 @@ func TestContacts(t *testing.T) {
 	UPDATE contacts_contact SET name = 'Eric', modified_on = '2020-08-20 14:00:00+00' where id = 2;`)
 	require.NoError(t, err)
 
-	// and simulate another indexer doing a parallel rebuild
-	ix2 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4)
+	// and simulate another indexer doing a parallel rebuild, using concurrent bulk requests
+	rt.Config.ContactsBulkWorkers = 3
+	ix2 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
 
-	indexName2, err := ix2.Index(rt, true, false)
+	indexName2, err := ix2.Index(ctx, rt, true, false)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedIndexName+"_1", indexName2) // new index used
 	assertIndexerStats(t, ix2, 8, 0)
@@ -245,9 +339,9 @@ func TestContacts(t *testing.T) {
 	// and the alias points to the new index
 	assertQuery(t, rt.Config, elastic.Match("name", "eric"), []int64{2})
 
-	// simulate another indexer doing a parallel rebuild with cleanup
-	ix3 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4)
-	indexName3, err := ix3.Index(rt, true, true)
+	// simulate another indexer doing a parallel rebuild with cleanup, with bulk requests so small they only fit one contact
+	ix3 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 500)
+	indexName3, err := ix3.Index(ctx, rt, true, true)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedIndexName+"_2", indexName3) // new index used
 	assertIndexerStats(t, ix3, 8, 0)
@@ -256,7 +350,495 @@ func TestContacts(t *testing.T) {
 	assertIndexesWithPrefix(t, rt.Config, rt.Config.ContactsIndex, []string{expectedIndexName + "_2"})
 
 	// check that the original indexer now indexes against the new index
-	indexName, err = ix1.Index(rt, false, false)
+	indexName, err = ix1.Index(ctx, rt, false, false)
 	assert.NoError(t, err)
 	assert.Equal(t, expectedIndexName+"_2", indexName)
+
+	// indexing with a cancelled context errors without doing anything
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	_, err = rt.DB.Exec(`UPDATE contacts_contact SET name = 'Bob', modified_on = '2020-08-25 14:00:00+00' where id = 1;`)
+	require.NoError(t, err)
+
+	_, err = ix1.Index(cancelledCtx, rt, false, false)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	time.Sleep(1 * time.Second)
+
+	assertQuery(t, rt.Config, elastic.Match("name", "bob"), []int64{})
+}
+
+func TestRetainAndRollback(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+
+	// can't rollback if there's no index at all
+	_, err := ix.Rollback(ctx)
+	assert.EqualError(t, err, "no current index for alias indexer_test")
+
+	expectedIndexName := fmt.Sprintf("indexer_test_%s", time.Now().Format("2006_01_02"))
+
+	indexName, err := ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName, indexName)
+
+	// or if there's no previous index
+	_, err = ix.Rollback(ctx)
+	assert.EqualError(t, err, fmt.Sprintf("no index older than %s to roll back to", expectedIndexName))
+
+	indexName, err = ix.Index(ctx, rt, true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName+"_1", indexName)
+
+	// rebuild with cleanup but retaining the newest old index
+	rt.Config.Retain = 1
+
+	indexName, err = ix.Index(ctx, rt, true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName+"_2", indexName)
+
+	time.Sleep(1 * time.Second)
+
+	assertIndexesWithPrefix(t, rt.Config, rt.Config.ContactsIndex, []string{expectedIndexName + "_1", expectedIndexName + "_2"})
+
+	// rollback should point our alias at the retained index
+	indexName, err = ix.Rollback(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName+"_1", indexName)
+	assert.Equal(t, []string{expectedIndexName + "_1"}, ix.FindIndexes(ctx))
+
+	// and the indexer continues indexing against it
+	indexName, err = ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName+"_1", indexName)
+
+	// but there's nothing further to roll back to
+	_, err = ix.Rollback(ctx)
+	assert.EqualError(t, err, fmt.Sprintf("no index older than %s to roll back to", expectedIndexName+"_1"))
+}
+
+func TestCleanupWithSnapshot(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+
+	// register a filesystem snapshot repository, requires path.repo to be configured on ES
+	elasticRequest(t, rt.Config, http.MethodPut, "/_snapshot/indexer_test", map[string]any{"type": "fs", "settings": map[string]any{"location": "/tmp/snapshots/indexer_test"}})
+	elasticRequest(t, rt.Config, http.MethodDelete, "/_snapshot/indexer_test/*", nil)
+
+	rt.Config.SnapshotRepository = "indexer_test"
+
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+
+	expectedIndexName := fmt.Sprintf("indexer_test_%s", time.Now().Format("2006_01_02"))
+
+	_, err := ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+
+	indexName, err := ix.Index(ctx, rt, true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName+"_1", indexName)
+
+	time.Sleep(1 * time.Second)
+
+	// old index was removed but only after being snapshotted
+	assertIndexesWithPrefix(t, rt.Config, rt.Config.ContactsIndex, []string{expectedIndexName + "_1"})
+
+	snapshots := elasticRequest(t, rt.Config, http.MethodGet, "/_snapshot/indexer_test/"+expectedIndexName, nil)
+	snapshot := snapshots["snapshots"].([]any)[0].(map[string]any)
+	assert.Equal(t, "SUCCESS", snapshot["state"])
+	assert.Equal(t, []any{expectedIndexName}, snapshot["indices"])
+}
+
+func TestContactsPartitioned(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+	rt.Config.ContactsPartitions = 2
+
+	// invalid owned partitions error
+	rt.Config.ContactsPartitionsOwned = "1,2"
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	_, err := ix.Index(ctx, rt, false, false)
+	assert.EqualError(t, err, "error parsing owned partitions: invalid partition '2', must be between 0 and 1")
+
+	// org 2 is in partition 0, so this instance only indexes its contacts
+	rt.Config.ContactsPartitionsOwned = "0"
+	ix1 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	_, err = ix1.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix1, 5, 0)
+
+	time.Sleep(1 * time.Second)
+
+	assertQuery(t, rt.Config, elastic.Match("org_id", 1), []int64{})
+	assertQuery(t, rt.Config, elastic.Match("org_id", 2), []int64{5, 6, 7, 8, 9})
+
+	// and org 1 in partition 1 is indexed by another instance
+	rt.Config.ContactsPartitionsOwned = "1"
+	ix2 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	_, err = ix2.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix2, 4, 0)
+
+	time.Sleep(1 * time.Second)
+
+	assertQuery(t, rt.Config, elastic.Match("org_id", 1), []int64{1, 2, 3, 4})
+
+	// each instance only picks up changes in its own partitions
+	_, err = rt.DB.Exec(`UPDATE contacts_contact SET name = 'Eric', modified_on = '2021-01-01 00:00:00+00' WHERE id IN (2, 6)`)
+	require.NoError(t, err)
+
+	_, err = ix2.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix2, 5, 0)
+
+	time.Sleep(1 * time.Second)
+
+	assertQuery(t, rt.Config, elastic.Match("name", "eric"), []int64{2})
+}
+
+func TestContactIndexerLockName(t *testing.T) {
+	cfg := runtime.NewDefaultConfig()
+	ix := indexers.NewContactIndexer("http://localhost:9200", "contacts", 2, 1, 4, 1_000_000)
+
+	assert.Equal(t, "contacts", ix.LockName(cfg))
+
+	// when partitioning, instances only compete for a lock with those that own the same partitions
+	cfg.ContactsPartitions = 4
+	assert.Equal(t, "contacts:0,1,2,3/4", ix.LockName(cfg))
+
+	cfg.ContactsPartitionsOwned = "2, 0,2"
+	assert.Equal(t, "contacts:0,2/4", ix.LockName(cfg))
+}
+
+func TestRebuildValidation(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+	rt.Config.RebuildValidate = true
+	rt.Config.RebuildValidateOrgs = true
+	rt.Config.RebuildTolerance = 0
+
+	expectedIndexName := fmt.Sprintf("indexer_test_%s", time.Now().Format("2006_01_02"))
+
+	// no replicas so that our single node cluster can be green
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 0, 4, 1_000_000)
+
+	indexName, err := ix.Index(ctx, rt, true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName, indexName)
+
+	// add a contact which the rebuild won't pick up because it was modified before the time rebuilds start from
+	_, err = rt.DB.Exec(`
+	INSERT INTO contacts_contact(id, is_active, created_by_id, created_on, modified_by_id, modified_on, org_id, status, uuid, fields, ticket_count)
+	VALUES(11, TRUE, -1, NOW(), -1, '0100-01-01 00:00:00+00 BC', 2, 'A', '0c6a6e0c-fa34-4b52-92ef-d4b2f2a1a0b9', '{}', 0)`)
+	require.NoError(t, err)
+
+	// rebuild drops that contact so fails validation and the alias isn't switched
+	_, err = ix.Index(ctx, rt, true, false)
+	assert.EqualError(t, err, fmt.Sprintf("rebuilt index %s_1 failed validation: index has 9 documents but there are 10 active contacts", expectedIndexName))
+	assert.Equal(t, []string{expectedIndexName}, ix.FindIndexes(ctx))
+
+	// but the invalid index is kept so that it can be resumed
+	assertIndexesWithPrefix(t, rt.Config, rt.Config.ContactsIndex, []string{expectedIndexName, expectedIndexName + "_1"})
+
+	// so if we allow for it, the next rebuild revalidates and switches to that index
+	rt.Config.RebuildTolerance = 0.2
+
+	indexName, err = ix.Index(ctx, rt, true, true)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName+"_1", indexName)
+	assert.Equal(t, []string{expectedIndexName + "_1"}, ix.FindIndexes(ctx))
+	assertIndexesWithPrefix(t, rt.Config, rt.Config.ContactsIndex, []string{expectedIndexName + "_1"})
+
+	// an index with replicas can't become green on our single node cluster
+	rt.Config.RebuildGreenTimeout = 1
+	ix2 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+
+	_, err = ix2.Index(ctx, rt, true, false)
+	assert.EqualError(t, err, fmt.Sprintf("rebuilt index %[1]s_2 failed validation: index %[1]s_2 not green after 1s, status is yellow", expectedIndexName))
+	assert.Equal(t, []string{expectedIndexName + "_1"}, ix2.FindIndexes(ctx))
+}
+
+func TestRebuildOptimized(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+	rt.Config.RebuildOptimize = true
+	rt.Config.RebuildForceMerge = true
+
+	// no replicas so that our single node cluster can be green
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 0, 4, 1_000_000)
+
+	indexName, err := ix.Index(ctx, rt, true, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix, 9, 0)
+
+	// bulk loading settings have been removed
+	settings := elasticRequest(t, rt.Config, http.MethodGet, "/"+indexName+"/_settings", nil)
+	index := settings[indexName].(map[string]any)["settings"].(map[string]any)["index"].(map[string]any)
+	assert.Equal(t, "0", index["number_of_replicas"])
+	assert.Nil(t, index["refresh_interval"])
+	assert.Nil(t, index["translog"])
+
+	// and everything is searchable
+	assertQuery(t, rt.Config, elastic.Match("org_id", 1), []int64{1, 2, 3, 4})
+
+	// replicas can't be allocated on our single node cluster, so we give up waiting for them after our timeout
+	rt.Config.RebuildReplicasTimeout = 1
+	ix2 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+
+	_, err = ix2.Index(ctx, rt, true, false)
+	assert.EqualError(t, err, fmt.Sprintf("error restoring settings of rebuilt index: error waiting for replicas: index %[1]s_1 not green after 1s, status is yellow", indexName))
+}
+
+func TestRebuildResume(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+
+	expectedIndexName := fmt.Sprintf("indexer_test_%s", time.Now().Format("2006_01_02"))
+
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+
+	_, err := ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+
+	indexName, err := ix.Index(ctx, rt, true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName+"_1", indexName)
+
+	// completed rebuilds record that in the index mappings
+	mappings := elasticRequest(t, rt.Config, http.MethodGet, "/"+indexName+"/_mapping", nil)
+	progress := mappings[indexName].(map[string]any)["mappings"].(map[string]any)["_meta"].(map[string]any)["rebuild"].(map[string]any)
+	assert.Equal(t, "complete", progress["status"])
+	assert.Equal(t, "2017-11-10T21:11:59.890662Z", progress["last_modified"])
+
+	// simulate that rebuild having been interrupted part way through
+	_, err = ix.Rollback(ctx)
+	require.NoError(t, err)
+
+	progress["status"] = "building"
+	progress["last_modified"] = "2017-01-01T00:00:00Z"
+	elasticRequest(t, rt.Config, http.MethodPut, "/"+indexName+"/_mapping", map[string]any{"_meta": map[string]any{"rebuild": progress}})
+
+	_, err = rt.DB.Exec(`UPDATE contacts_contact SET name = 'Bob', modified_on = '2017-06-01 00:00:00+00' where id = 2;`)
+	require.NoError(t, err)
+
+	// can't resume it while another process is rebuilding
+	ix2 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+
+	lock := utils.NewLock(rt.DB, "rebuild:indexer_test")
+	held, err := lock.Acquire(ctx)
+	require.NoError(t, err)
+	require.True(t, held)
+
+	_, err = ix2.Index(ctx, rt, true, false)
+	assert.EqualError(t, err, "another rebuild of indexer_test is already in progress")
+
+	require.NoError(t, lock.Release(ctx))
+
+	// next rebuild should resume filling that index from where it got to, rather than creating a new index
+	indexName, err = ix2.Index(ctx, rt, true, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName+"_1", indexName)
+	assertIndexerStats(t, ix2, 1, 0) // others after the cursor were already indexed so are conflicts
+	assert.Equal(t, []string{expectedIndexName + "_1"}, ix2.FindIndexes(ctx))
+
+	time.Sleep(1 * time.Second)
+
+	assertQuery(t, rt.Config, elastic.Match("name", "bob"), []int64{2})
+}
+
+func TestContactsOutdatedDefinition(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	indexName, err := ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assert.False(t, ix.Stats().Outdated)
+
+	// changing the number of shards or replicas doesn't make it outdated
+	ix1 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 1, 0, 4, 1_000_000)
+	_, err = ix1.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assert.False(t, ix1.Stats().Outdated)
+
+	// simulate the index having been created with an older definition
+	elasticRequest(t, rt.Config, http.MethodPut, "/"+indexName+"/_mapping", map[string]any{"_meta": map[string]any{"definition": "abc123"}})
+
+	ix2 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	_, err = ix2.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assert.True(t, ix2.Stats().Outdated)
+
+	// once rebuilt, the index is up to date
+	_, err = ix2.Index(ctx, rt, true, false)
+	assert.NoError(t, err)
+	_, err = ix2.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assert.False(t, ix2.Stats().Outdated)
+}
+
+func TestContactsWatermarks(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+	rt.Watermarks = watermarks.NewFileStore(filepath.Join(t.TempDir(), "watermarks.json"))
+
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	indexName, err := ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+
+	// we should have a watermark for the last contact indexed
+	watermark, err := rt.Watermarks.Get(ctx, "indexer_test")
+	require.NoError(t, err)
+	require.NotNil(t, watermark)
+	assert.Equal(t, indexName, watermark.Index)
+	assert.Equal(t, time.Date(2017, 11, 10, 21, 11, 59, 890662000, time.UTC), watermark.ModifiedOn.UTC())
+	assert.Contains(t, []int64{1, 6, 8}, watermark.ID)
+
+	// move the watermark past a contact change and a new indexer should use it rather than what's in the index
+	watermark.ModifiedOn = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, rt.Watermarks.Set(ctx, "indexer_test", watermark))
+
+	_, err = rt.DB.Exec(`UPDATE contacts_contact SET name = 'Bob', modified_on = '2020-01-01 00:00:00+00' where id = 2;`)
+	require.NoError(t, err)
+
+	ix2 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	_, err = ix2.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix2, 0, 0)
+
+	// watermarks for other indexes are ignored
+	watermark.Index = "indexer_test_2000_01_01"
+	require.NoError(t, rt.Watermarks.Set(ctx, "indexer_test", watermark))
+
+	ix3 := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	_, err = ix3.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix3, 1, 0)
+
+	watermark, err = rt.Watermarks.Get(ctx, "indexer_test")
+	require.NoError(t, err)
+	assert.Equal(t, indexName, watermark.Index)
+	assert.Equal(t, int64(2), watermark.ID)
+
+	time.Sleep(1 * time.Second)
+
+	assertQuery(t, rt.Config, elastic.Match("name", "bob"), []int64{2})
+}
+
+func TestContactsSkipUnchanged(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+	rt.Config.ContactsHashCache = 1000
+
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	_, err := ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix, 9, 0)
+	assert.Equal(t, int64(2), ix.Stats().Sanitized)
+
+	// touch some contacts without changing anything, and change another
+	_, err = rt.DB.Exec(`UPDATE contacts_contact SET modified_on = '2020-01-01 00:00:00+00' WHERE id IN (3, 4, 5)`)
+	require.NoError(t, err)
+	_, err = rt.DB.Exec(`UPDATE contacts_contact SET name = 'Bob', modified_on = '2020-01-01 00:00:00+00' WHERE id = 2`)
+	require.NoError(t, err)
+
+	// only the changed contact is reindexed, and only its sanitized values are counted again
+	_, err = ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix, 10, 0)
+	assert.Equal(t, int64(3), ix.Stats().Sanitized)
+
+	// removing a contact from a group is a change
+	_, err = rt.DB.Exec(`DELETE FROM contacts_contactgroup_contacts WHERE contact_id = 1 AND contactgroup_id = 4;
+	UPDATE contacts_contact SET modified_on = '2020-01-02 00:00:00+00' WHERE id = 1`)
+	require.NoError(t, err)
+
+	_, err = ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix, 11, 0)
+
+	// if the newest contacts are skipped, we've still reached them even though ES has nothing as new
+	_, err = rt.DB.Exec(`UPDATE contacts_contact SET modified_on = '2020-01-03 00:00:00+00' WHERE id = 3`)
+	require.NoError(t, err)
+
+	_, err = ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix, 11, 0)
+	assert.Equal(t, time.Date(2020, 1, 3, 0, 0, 0, 0, time.UTC), ix.Stats().LastModified.UTC())
+
+	time.Sleep(1 * time.Second)
+
+	assertQuery(t, rt.Config, elastic.Match("name", "bob"), []int64{2})
+	assertQuery(t, rt.Config, elastic.Match("group_ids", 4), []int64{2})
+}
+
+func TestReportIgnored(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	indexName, err := ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+
+	// values we index are sanitized so nothing is ignored
+	time.Sleep(1 * time.Second)
+
+	count, err := ix.CountIgnored(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	report, err := ix.ReportIgnored(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, indexers.IgnoredReport{}, report)
+
+	// but documents indexed by other means might have malformed values
+	elasticRequest(t, rt.Config, http.MethodPut, "/"+indexName+"/_doc/100?routing=2&refresh=true", map[string]any{
+		"id":     100,
+		"org_id": 2,
+		"fields": []any{
+			map[string]any{"field": "05bca1cd-e322-4837-9595-86d0d85e5adb", "text": "lots", "number": "lots"},
+		},
+	})
+
+	count, err = ix.CountIgnored(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	report, err = ix.ReportIgnored(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, indexers.IgnoredReport{2: {"05bca1cd-e322-4837-9595-86d0d85e5adb": 1}}, report)
+}
+
+func TestContactNames(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+
+	_, err := rt.DB.Exec(`
+	UPDATE contacts_contact SET name = 'Côte Dâne' WHERE id = 7;
+	UPDATE contacts_contact SET name = '王小明' WHERE id = 8;
+	UPDATE contacts_contact SET name = 'أحمد علي' WHERE id = 9;
+	UPDATE contacts_contact SET name = 'Пётр Ёлкин' WHERE id = 6;`)
+	require.NoError(t, err)
+
+	ix := indexers.NewContactIndexer(rt.Config.ElasticURL, rt.Config.ContactsIndex, 2, 1, 4, 1_000_000)
+	_, err = ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+
+	time.Sleep(1 * time.Second)
+
+	assertQuery(t, rt.Config, elastic.Match("name", "cote"), []int64{})
+	assertQuery(t, rt.Config, elastic.Match("name", "côte"), []int64{7})
+	assertQuery(t, rt.Config, elastic.Match("name.folded", "cote"), []int64{7})
+	assertQuery(t, rt.Config, elastic.Match("name.folded", "CÔTE"), []int64{7})
+	assertQuery(t, rt.Config, elastic.Match("name.folded", "da"), []int64{5, 7}) // prefixes of Dane and Dâne
+	assertQuery(t, rt.Config, elastic.Match("name.arabic", "احمد"), []int64{9})  // alef with hamza is normalized
+	assertQuery(t, rt.Config, elastic.MatchPhrase("name.cjk", "小明"), []int64{8})
+	assertQuery(t, rt.Config, elastic.MatchPhrase("name.cjk", "王小"), []int64{8})
+	assertQuery(t, rt.Config, elastic.Match("name", "ПЁТР"), []int64{6})
+	assertQuery(t, rt.Config, elastic.Match("name", "петр"), []int64{})
+	assertQuery(t, rt.Config, elastic.Match("name.folded", "петр"), []int64{6}) // ё is folded to е
+	assertQuery(t, rt.Config, elastic.Match("name.folded", "Елк"), []int64{6})
 }
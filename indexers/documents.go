@@ -0,0 +1,230 @@
+package indexers
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// a record fetched from the database, to be indexed or deleted if it's no longer active
+type document struct {
+	ID         int64
+	OrgID      int64
+	ModifiedOn time.Time
+	IsActive   bool
+	Source     []byte   // JSON source of the document
+	Hash       uint64   // hash of the content of the document, excluding its modified time, if known
+	Sanitized  []string // descriptions of values which were fixed so that the document could be indexed
+}
+
+// the values sanitized in documents of an org
+type sanitizedValues struct {
+	documents int
+	values    int
+	examples  []string
+}
+
+func (s *sanitizedValues) add(id int64, problems []string) {
+	s.documents++
+	s.values += len(problems)
+
+	for _, p := range problems {
+		if len(s.examples) < 5 {
+			s.examples = append(s.examples, fmt.Sprintf("#%d %s", id, p))
+		}
+	}
+}
+
+// a content hash of a document to be recorded once that document has been indexed
+type pendingHash struct {
+	id   int64
+	hash uint64
+}
+
+// fetches records modified on or after the given time in order of modified_on, passing each to the given func
+type fetchFunc func(ctx context.Context, lastModified time.Time, each func(*document) error) error
+
+// returns a fetch func which uses a query which takes the modified time as its first parameter, followed by the given
+// args, and returns rows of (org_id, id, modified_on, is_active, json)
+func fetchByQuery(db *sql.DB, query string, args ...any) fetchFunc {
+	return func(ctx context.Context, lastModified time.Time, each func(*document) error) error {
+		rows, err := db.QueryContext(ctx, query, append([]any{lastModified}, args...)...)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			d := &document{}
+			if err := rows.Scan(&d.OrgID, &d.ID, &d.ModifiedOn, &d.IsActive, &d.Source); err != nil {
+				return err
+			}
+			if err := each(d); err != nil {
+				return err
+			}
+		}
+
+		return rows.Err()
+	}
+}
+
+// indexes all documents fetched with a lastModified greater than or equal to the passed in time, returning the
+// modified time of the last document indexed. Bulk requests are sent by the given number of concurrent workers whilst
+// we continue fetching, and the progress func is called with the modified time and id of the last document of each
+// batch once that batch has been indexed. If we're keeping document hashes, documents whose content hasn't changed
+// since they were last indexed are skipped, unless we're rebuilding.
+func (i *baseIndexer) indexModified(ctx context.Context, index string, lastModified time.Time, rebuild bool, workers int, fetch fetchFunc, progress func(time.Time, int64) error) (time.Time, error) {
+	totalFetched, totalCreated, totalUpdated, totalDeleted, totalSkipped := 0, 0, 0, 0, 0
+
+	var lastID int64
+
+	start := time.Now()
+
+	for {
+		batchStart := time.Now() // start time for this batch
+		batchFetched := 0        // documents fetched in this batch
+		batchSkipped := 0        // documents skipped because they haven't changed
+		batchHashes := make([]pendingHash, 0)
+		batchSanitized := make(map[int64]*sanitizedValues) // values sanitized in documents we've sent, by org
+
+		queryModified := lastModified
+
+		sender := i.newBulkSender(ctx, index, workers, i.sizer)
+		subBatch := &bytes.Buffer{}
+		subBatchDocs := 0
+
+		sendSubBatch := func() error {
+			if err := sender.Send(subBatch.Bytes(), subBatchDocs); err != nil {
+				return err
+			}
+			subBatch = &bytes.Buffer{}
+			subBatchDocs = 0
+			return nil
+		}
+
+		err := fetch(ctx, lastModified, func(d *document) error {
+			batchFetched++
+			lastModified = d.ModifiedOn
+			lastID = d.ID
+
+			if i.hashes != nil {
+				if d.IsActive && d.Hash != 0 && !rebuild && i.hashes.Has(index, d.ID, d.Hash) {
+					batchSkipped++
+					return nil
+				}
+				if d.IsActive {
+					batchHashes = append(batchHashes, pendingHash{id: d.ID, hash: d.Hash})
+				} else {
+					batchHashes = append(batchHashes, pendingHash{id: d.ID})
+				}
+			}
+
+			if len(d.Sanitized) > 0 {
+				if batchSanitized[d.OrgID] == nil {
+					batchSanitized[d.OrgID] = &sanitizedValues{}
+				}
+				batchSanitized[d.OrgID].add(d.ID, d.Sanitized)
+			}
+
+			var cmd string
+			if d.IsActive {
+				i.log().Debug("modified document", "id", d.ID, "modifiedOn", d.ModifiedOn, "source", string(d.Source))
+
+				cmd = fmt.Sprintf(indexCommand, d.ID, d.ModifiedOn.UnixNano(), d.OrgID) + "\n" + string(d.Source) + "\n"
+			} else {
+				i.log().Debug("deleted document", "id", d.ID, "modifiedOn", d.ModifiedOn)
+
+				cmd = fmt.Sprintf(deleteCommand, d.ID, d.ModifiedOn.UnixNano(), d.OrgID) + "\n"
+			}
+
+			// if this document would take our request over the size limit, send what we have first
+			if !i.sizer.Fits(subBatch.Len(), len(cmd)) {
+				if err := sendSubBatch(); err != nil {
+					return err
+				}
+			}
+
+			subBatch.WriteString(cmd)
+			subBatchDocs++
+
+			// hand off to our bulk workers once we have enough documents
+			if subBatchDocs >= i.sizer.Docs() {
+				return sendSubBatch()
+			}
+			return nil
+		})
+		if err == nil && subBatch.Len() > 0 {
+			err = sendSubBatch()
+		}
+		if err != nil {
+			sender.Abort()
+			return time.Time{}, err
+		}
+
+		// wait for all of this batch to be sent so we know whether we've seen it all
+		if err := sender.Wait(); err != nil {
+			return time.Time{}, err
+		}
+
+		// now that this batch has been indexed, remember the content of what we sent
+		for _, h := range batchHashes {
+			i.hashes.Put(index, h.id, h.hash)
+		}
+
+		// record how far we've got in case we're interrupted
+		if batchFetched > 0 {
+			if err := progress(lastModified, lastID); err != nil {
+				return time.Time{}, err
+			}
+		}
+
+		batchCreated := sender.created // documents created in ES
+		batchUpdated := sender.updated // documents updated in ES
+		batchDeleted := sender.deleted // documents deleted in ES
+		batchESTime := sender.elapsed  // time spent by workers indexing this batch
+
+		totalFetched += batchFetched
+		totalCreated += batchCreated
+		totalUpdated += batchUpdated
+		totalDeleted += batchDeleted
+		totalSkipped += batchSkipped
+
+		totalTime := time.Since(start)
+		batchTime := time.Since(batchStart)
+		batchRate := int(float32(batchFetched) / (float32(batchTime) / float32(time.Second)))
+
+		log := i.log().With("index", index,
+			"rate", batchRate,
+			"batch_fetched", batchFetched,
+			"batch_created", batchCreated,
+			"batch_updated", batchUpdated,
+			"batch_skipped", batchSkipped,
+			"batch_elapsed", batchTime,
+			"batch_elapsed_es", batchESTime,
+			"total_fetched", totalFetched,
+			"total_created", totalCreated,
+			"total_updated", totalUpdated,
+			"total_skipped", totalSkipped,
+			"total_elapsed", totalTime,
+		)
+
+		// if we're rebuilding, always log batch progress
+		if rebuild {
+			log.Info("indexed batch")
+		} else {
+			log.Debug("indexed batch")
+		}
+
+		i.recordActivity(batchCreated+batchUpdated, batchDeleted, time.Since(batchStart))
+		i.recordSanitized(batchSanitized)
+
+		// last modified stayed the same and we didn't add anything, seen it all, break out
+		if lastModified.Equal(queryModified) && batchCreated == 0 {
+			break
+		}
+	}
+
+	return lastModified, nil
+}
@@ -0,0 +1,31 @@
+package indexers
+
+import (
+	"context"
+	"time"
+)
+
+// exposes internals for unit tests in the indexers_test package
+
+type Backpressure = backpressure
+
+var NewBackpressure = newBackpressure
+
+func (b *backpressure) Check(ctx context.Context) (string, error) { return b.check(ctx) }
+
+func (b *backpressure) PausedFor() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return time.Until(b.pausedUntil)
+}
+
+type BulkSizer = bulkSizer
+
+var NewBulkSizer = newBulkSizer
+
+func NewBulkSizerAt(maxDocs, maxBytes, docs int) *bulkSizer {
+	s := newBulkSizer(maxDocs, maxBytes)
+	s.docs = docs
+	return s
+}
@@ -0,0 +1,68 @@
+package indexers
+
+import (
+	"encoding/json"
+	"hash/fnv"
+)
+
+// hashCache remembers the content hashes of recently indexed documents so that documents which were modified without
+// their content changing don't need to be reindexed. It holds at most size hashes in each of two generations, and
+// when the current generation is full it becomes the previous one, so the least recently seen hashes are dropped.
+type hashCache struct {
+	size     int
+	index    string // the physical index our hashes are for
+	current  map[int64]uint64
+	previous map[int64]uint64
+}
+
+func newHashCache(size int) *hashCache {
+	return &hashCache{size: size, current: make(map[int64]uint64), previous: make(map[int64]uint64)}
+}
+
+// Has returns whether the document with the given id was last indexed into the given index with the given hash
+func (c *hashCache) Has(index string, id int64, hash uint64) bool {
+	if index != c.index {
+		return false
+	}
+
+	h, found := c.current[id]
+	if !found {
+		h, found = c.previous[id]
+		if found {
+			c.put(id, h) // keep it around
+		}
+	}
+	return found && h == hash
+}
+
+// Put records the hash of a document indexed into the given index, or removes it if the hash is zero
+func (c *hashCache) Put(index string, id int64, hash uint64) {
+	if index != c.index {
+		c.index = index
+		c.current = make(map[int64]uint64)
+		c.previous = make(map[int64]uint64)
+	}
+
+	if hash == 0 {
+		delete(c.current, id)
+		delete(c.previous, id)
+	} else {
+		c.put(id, hash)
+	}
+}
+
+func (c *hashCache) put(id int64, hash uint64) {
+	if len(c.current) >= c.size {
+		c.previous = c.current
+		c.current = make(map[int64]uint64, c.size)
+	}
+	c.current[id] = hash
+}
+
+// hashes the JSON of the given value
+func hashJSON(v any) uint64 {
+	data, _ := json.Marshal(v)
+	h := fnv.New64a()
+	h.Write(data)
+	return h.Sum64()
+}
@@ -0,0 +1,183 @@
+package indexers
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/rp-indexer/v10/utils"
+)
+
+// IgnoredReport is the number of documents in each org which have values that ES ignored, e.g. because they were
+// malformed, by field. Values of contact fields are keyed by the field UUID, and any others are counted together.
+type IgnoredReport map[int64]map[string]int
+
+// the key in an ignored report for values ignored outside of contact fields
+const IgnoredOther = "other"
+
+// IgnoredCount is the number of ignored values for an org or field
+type IgnoredCount struct {
+	Key   string
+	Count int
+}
+
+// TopOrgs returns the n orgs with the most ignored values, most first
+func (r IgnoredReport) TopOrgs(n int) []IgnoredCount {
+	totals := make(map[string]int, len(r))
+	for orgID, byField := range r {
+		for _, count := range byField {
+			totals[strconv.FormatInt(orgID, 10)] += count
+		}
+	}
+	return topIgnored(totals, n)
+}
+
+// TopFields returns the n fields with the most ignored values across all orgs, most first
+func (r IgnoredReport) TopFields(n int) []IgnoredCount {
+	totals := make(map[string]int)
+	for _, byField := range r {
+		for field, count := range byField {
+			totals[field] += count
+		}
+	}
+	return topIgnored(totals, n)
+}
+
+func topIgnored(totals map[string]int, n int) []IgnoredCount {
+	counts := make([]IgnoredCount, 0, len(totals))
+	for key, count := range totals {
+		counts = append(counts, IgnoredCount{Key: key, Count: count})
+	}
+	slices.SortFunc(counts, func(a, b IgnoredCount) int {
+		return cmp.Or(cmp.Compare(b.Count, a.Count), cmp.Compare(a.Key, b.Key))
+	})
+	return counts[:min(n, len(counts))]
+}
+
+// query for documents with ignored values
+var ignoredQuery = map[string]any{"exists": map[string]any{"field": "_ignored"}}
+
+// query for contact documents with ignored values at the top level or in nested contact fields
+var contactsIgnoredQuery = map[string]any{
+	"bool": map[string]any{
+		"should": []any{
+			map[string]any{"exists": map[string]any{"field": "_ignored"}},
+			map[string]any{"nested": map[string]any{"path": "fields", "query": map[string]any{"exists": map[string]any{"field": "_ignored"}}}},
+		},
+	},
+}
+
+// CountIgnored counts the documents in our index which have values that ES ignored
+func (i *baseIndexer) CountIgnored(ctx context.Context) (int, error) {
+	return i.countIgnored(ctx, ignoredQuery)
+}
+
+// CountIgnored counts the documents in our index which have values that ES ignored, including in contact fields
+func (i *ContactIndexer) CountIgnored(ctx context.Context) (int, error) {
+	return i.countIgnored(ctx, contactsIgnoredQuery)
+}
+
+func (i *baseIndexer) countIgnored(ctx context.Context, query any) (int, error) {
+	response := &countResponse{}
+	_, err := utils.MakeJSONRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/_count", i.elasticURL, i.name), jsonx.MustMarshal(map[string]any{"query": query}), response)
+	if err != nil {
+		return 0, fmt.Errorf("error counting documents with ignored values: %w", err)
+	}
+	return response.Count, nil
+}
+
+type termBuckets struct {
+	Buckets []struct {
+		Key      string `json:"key"`
+		DocCount int    `json:"doc_count"`
+	} `json:"buckets"`
+}
+
+// our response for a page of ignored values aggregated by org
+type ignoredResponse struct {
+	Aggregations struct {
+		Orgs struct {
+			AfterKey *struct {
+				OrgID int64 `json:"org_id"`
+			} `json:"after_key"`
+			Buckets []struct {
+				Key struct {
+					OrgID int64 `json:"org_id"`
+				} `json:"key"`
+				Ignored struct {
+					DocCount int `json:"doc_count"`
+				} `json:"ignored"`
+				Fields struct {
+					Ignored struct {
+						ByField termBuckets `json:"by_field"`
+					} `json:"ignored"`
+				} `json:"fields"`
+			} `json:"buckets"`
+		} `json:"orgs"`
+	} `json:"aggregations"`
+}
+
+// ReportIgnored finds the documents in our index which have values that ES ignored, aggregated by org and field
+func (i *ContactIndexer) ReportIgnored(ctx context.Context) (IgnoredReport, error) {
+	report := make(IgnoredReport)
+	var after any
+
+	for {
+		composite := map[string]any{
+			"size":    100,
+			"sources": []any{map[string]any{"org_id": map[string]any{"terms": map[string]any{"field": "org_id"}}}},
+		}
+		if after != nil {
+			composite["after"] = after
+		}
+
+		search := map[string]any{
+			"size":             0,
+			"track_total_hits": false,
+			"query":            contactsIgnoredQuery,
+			"aggs": map[string]any{
+				"orgs": map[string]any{
+					"composite": composite,
+					"aggs": map[string]any{
+						"ignored": map[string]any{"filter": map[string]any{"exists": map[string]any{"field": "_ignored"}}},
+						"fields": map[string]any{
+							"nested": map[string]any{"path": "fields"},
+							"aggs": map[string]any{
+								"ignored": map[string]any{
+									"filter": map[string]any{"exists": map[string]any{"field": "_ignored"}},
+									"aggs":   map[string]any{"by_field": map[string]any{"terms": map[string]any{"field": "fields.field", "size": 1000}}},
+								},
+							},
+						},
+					},
+				},
+			},
+		}
+
+		response := &ignoredResponse{}
+		_, err := utils.MakeJSONRequest(ctx, http.MethodPost, fmt.Sprintf("%s/%s/_search", i.elasticURL, i.name), jsonx.MustMarshal(search), response)
+		if err != nil {
+			return nil, fmt.Errorf("error aggregating ignored values: %w", err)
+		}
+
+		for _, b := range response.Aggregations.Orgs.Buckets {
+			byField := make(map[string]int)
+			if b.Ignored.DocCount > 0 {
+				byField[IgnoredOther] = b.Ignored.DocCount
+			}
+			for _, f := range b.Fields.Ignored.ByField.Buckets {
+				byField[f.Key] = f.DocCount
+			}
+			report[b.Key.OrgID] = byField
+		}
+
+		if response.Aggregations.Orgs.AfterKey == nil || len(response.Aggregations.Orgs.Buckets) == 0 {
+			return report, nil
+		}
+		after = response.Aggregations.Orgs.AfterKey
+	}
+}
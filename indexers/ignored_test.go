@@ -0,0 +1,26 @@
+package indexers_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/rp-indexer/v10/indexers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIgnoredReportTop(t *testing.T) {
+	report := indexers.IgnoredReport{
+		1: {"05bca1cd-e322-4837-9595-86d0d85e5adb": 3, indexers.IgnoredOther: 1},
+		2: {"05bca1cd-e322-4837-9595-86d0d85e5adb": 2},
+		3: {"e0eac267-463a-4c00-9732-cab62df07b16": 5, indexers.IgnoredOther: 2},
+	}
+
+	assert.Equal(t, []indexers.IgnoredCount{{"3", 7}, {"1", 4}}, report.TopOrgs(2))
+	assert.Equal(t, []indexers.IgnoredCount{{"3", 7}, {"1", 4}, {"2", 2}}, report.TopOrgs(10))
+	assert.Equal(t, []indexers.IgnoredCount{
+		{"05bca1cd-e322-4837-9595-86d0d85e5adb", 5},
+		{"e0eac267-463a-4c00-9732-cab62df07b16", 5},
+		{indexers.IgnoredOther, 3},
+	}, report.TopFields(10))
+
+	assert.Equal(t, []indexers.IgnoredCount{}, indexers.IgnoredReport{}.TopOrgs(10))
+}
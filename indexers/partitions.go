@@ -0,0 +1,62 @@
+package indexers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// partition is a subset of orgs, those whose id modulo the total number of partitions equals num. A partition
+// with a total of zero is all orgs.
+type partition struct {
+	num   int
+	total int
+}
+
+// returns the ES query to restrict searches to documents in this partition, or nil if this is all orgs
+func (p partition) esQuery() any {
+	if p.total == 0 {
+		return nil
+	}
+
+	return map[string]any{
+		"script": map[string]any{
+			"script": map[string]any{
+				"source": "doc['org_id'].value % params.total == params.num",
+				"params": map[string]any{"total": p.total, "num": p.num},
+			},
+		},
+	}
+}
+
+// parses a comma separated list of partition numbers, e.g. "0,2", where an empty list is all partitions
+func parsePartitions(owned string, total int) ([]partition, error) {
+	if total <= 0 {
+		return []partition{{}}, nil
+	}
+
+	if strings.TrimSpace(owned) == "" {
+		all := make([]partition, total)
+		for n := range total {
+			all[n] = partition{num: n, total: total}
+		}
+		return all, nil
+	}
+
+	parts := strings.Split(owned, ",")
+	partitions := make([]partition, 0, len(parts))
+	seen := make(map[int]bool, len(parts))
+
+	for _, s := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n < 0 || n >= total {
+			return nil, fmt.Errorf("invalid partition '%s', must be between 0 and %d", strings.TrimSpace(s), total-1)
+		}
+		if !seen[n] {
+			partitions = append(partitions, partition{num: n, total: total})
+			seen[n] = true
+		}
+	}
+
+	return partitions, nil
+}
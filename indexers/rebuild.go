@@ -0,0 +1,195 @@
+package indexers
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nyaruka/gocommon/jsonx"
+	"github.com/nyaruka/rp-indexer/v10/utils"
+)
+
+const (
+	rebuildStatusBuilding = "building" // still being built, so can be resumed
+	rebuildStatusComplete = "complete" // built and switched to
+)
+
+// rebuildProgress is stored in the _meta of the mappings of an index being rebuilt, so that if the rebuild is
+// interrupted, the next rebuild can resume filling the same index rather than starting again
+type rebuildProgress struct {
+	Status       string    `json:"status"`
+	Definition   string    `json:"definition"` // hash of the index definition it was created with
+	Optimized    bool      `json:"optimized"`  // whether it was created with bulk loading settings
+	StartedOn    time.Time `json:"started_on"`
+	LastModified time.Time `json:"last_modified"` // modified time of the last document indexed
+}
+
+// returns a hash of the analysis and mappings of our index definition, so we can tell if an index was created with a
+// different definition. Other settings like the number of replicas don't affect what's indexed so aren't included.
+func (i *baseIndexer) definitionHash() string {
+	h := sha1.Sum(jsonx.MustMarshal(map[string]any{"analysis": i.definition.Settings.Analysis, "mappings": i.definition.Mappings}))
+	return hex.EncodeToString(h[:])
+}
+
+// indexMeta is stored in the _meta of the mappings of our indexes
+type indexMeta struct {
+	Definition string           `json:"definition,omitempty"` // hash of the index definition it was created with
+	Rebuild    *rebuildProgress `json:"rebuild,omitempty"`
+}
+
+// our response for the mappings of an index
+type mappingResponse map[string]struct {
+	Mappings struct {
+		Meta indexMeta `json:"_meta"`
+	} `json:"mappings"`
+}
+
+// gets the meta stored on the given index
+func (i *baseIndexer) getIndexMeta(ctx context.Context, index string) (*indexMeta, error) {
+	response := mappingResponse{}
+	if _, err := utils.MakeJSONRequest(ctx, http.MethodGet, fmt.Sprintf("%s/%s/_mapping", i.elasticURL, index), nil, &response); err != nil {
+		return nil, err
+	}
+
+	meta := response[index].Mappings.Meta
+	return &meta, nil
+}
+
+// stores the given meta on the given index, replacing any existing meta
+func (i *baseIndexer) setIndexMeta(ctx context.Context, index string, meta *indexMeta) error {
+	body := jsonx.MustMarshal(map[string]any{"_meta": meta})
+
+	_, err := utils.MakeJSONRequest(ctx, http.MethodPut, fmt.Sprintf("%s/%s/_mapping", i.elasticURL, index), body, nil)
+	return err
+}
+
+// gets the rebuild progress stored on the given index, if any
+func (i *baseIndexer) getRebuildProgress(ctx context.Context, index string) (*rebuildProgress, error) {
+	meta, err := i.getIndexMeta(ctx, index)
+	if err != nil {
+		return nil, err
+	}
+	return meta.Rebuild, nil
+}
+
+// stores the given rebuild progress on the given index
+func (i *baseIndexer) setRebuildProgress(ctx context.Context, index string, progress *rebuildProgress) error {
+	return i.setIndexMeta(ctx, index, &indexMeta{Definition: i.definitionHash(), Rebuild: progress})
+}
+
+// checks whether the given index was created with our current definition, logging an error if it wasn't, e.g. because
+// new fields have been added to the mappings since, as queries on those will find nothing until it's rebuilt
+func (i *baseIndexer) checkDefinition(ctx context.Context, index string) error {
+	if i.checkedIndex == index {
+		return nil
+	}
+
+	meta, err := i.getIndexMeta(ctx, index)
+	if err != nil {
+		return fmt.Errorf("error reading meta of index %s: %w", index, err)
+	}
+
+	i.checkedIndex = index
+	i.stats.Outdated = meta.Definition != i.definitionHash()
+
+	if i.stats.Outdated {
+		i.log().Error("index was created with a different definition and needs to be rebuilt", "index", index)
+	}
+	return nil
+}
+
+// finds an index newer than our current one whose rebuild was interrupted and can be resumed
+func (i *baseIndexer) findResumableRebuild(ctx context.Context) (string, *rebuildProgress, error) {
+	current := ""
+	if currents := i.FindIndexes(ctx); len(currents) > 0 {
+		current = currents[0]
+	}
+
+	all, err := i.findAllIndexes(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for _, idx := range all {
+		if utils.CompareIndexNames(idx, current) <= 0 {
+			break
+		}
+
+		progress, err := i.getRebuildProgress(ctx, idx)
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading rebuild progress of %s: %w", idx, err)
+		}
+
+		if progress != nil && progress.Status == rebuildStatusBuilding && progress.Definition == i.definitionHash() {
+			return idx, progress, nil
+		}
+	}
+
+	return "", nil, nil
+}
+
+// starts tracking the progress of a rebuild into the given index, which is either new or being resumed
+func (i *baseIndexer) startRebuild(ctx context.Context, index string, resumed *rebuildProgress, optimized bool) error {
+	progress := resumed
+	if progress == nil {
+		progress = &rebuildProgress{Status: rebuildStatusBuilding, Definition: i.definitionHash(), Optimized: optimized, StartedOn: time.Now()}
+
+		if err := i.setRebuildProgress(ctx, index, progress); err != nil {
+			return fmt.Errorf("error storing rebuild progress: %w", err)
+		}
+	}
+
+	i.rebuildIndex = index
+	i.rebuildProgress = progress
+	return nil
+}
+
+// records that the rebuild into the given index has indexed everything up to the given modified time
+func (i *baseIndexer) recordRebuildProgress(ctx context.Context, index string, lastModified time.Time) error {
+	if i.rebuildProgress == nil || i.rebuildIndex != index || !lastModified.After(i.rebuildProgress.LastModified) {
+		return nil
+	}
+
+	i.rebuildProgress.LastModified = lastModified
+
+	if err := i.setRebuildProgress(ctx, index, i.rebuildProgress); err != nil {
+		return fmt.Errorf("error storing rebuild progress: %w", err)
+	}
+	return nil
+}
+
+// ends tracking of the current rebuild, recording its final status
+func (i *baseIndexer) endRebuild(ctx context.Context, status string) error {
+	if i.rebuildProgress == nil {
+		return nil
+	}
+
+	progress, index := i.rebuildProgress, i.rebuildIndex
+	i.rebuildProgress, i.rebuildIndex = nil, ""
+
+	progress.Status = status
+
+	if err := i.setRebuildProgress(ctx, index, progress); err != nil {
+		return fmt.Errorf("error storing rebuild progress: %w", err)
+	}
+
+	i.log().Info("ended rebuild", "index", index, "status", status, "elapsed", time.Since(progress.StartedOn))
+	return nil
+}
+
+// ends the current rebuild without switching to it, e.g. because it failed validation. Its index is left unaliased
+// with its progress still as building, so that the next rebuild resumes and revalidates it rather than starting again,
+// and once another index is switched to, cleanup can remove it.
+func (i *baseIndexer) abandonRebuild() {
+	if i.rebuildProgress == nil {
+		return
+	}
+
+	index := i.rebuildIndex
+	i.rebuildProgress, i.rebuildIndex = nil, ""
+
+	i.log().Info("abandoned rebuild", "index", index)
+}
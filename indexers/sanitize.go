@@ -0,0 +1,95 @@
+package indexers
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+	"unicode/utf8"
+)
+
+// limits on the values of contact documents, beyond which ES would reject or quietly drop them
+const (
+	contactMaxNameLength  = 128
+	contactMaxTextLength  = 640
+	contactMaxFields      = 250
+	contactMaxURNs        = 100
+	contactMaxURNLength   = 255
+	contactMaxNumberValue = 1e14 // numbers are indexed as scaled floats with a factor of 10,000 so must fit in a long
+)
+
+var contactMaxNumber = big.NewFloat(contactMaxNumberValue)
+
+// Sanitize enforces limits on the values of this document, truncating text which is too long and removing values
+// which can't be indexed, and returns descriptions of any problems it fixed
+func (c *ContactDoc) Sanitize() []string {
+	var problems []string
+
+	if c.Name != nil && utf8.RuneCountInString(*c.Name) > contactMaxNameLength {
+		name := truncate(*c.Name, contactMaxNameLength)
+		c.Name = &name
+		problems = append(problems, "name is too long")
+	}
+
+	if len(c.URNs) > contactMaxURNs {
+		problems = append(problems, fmt.Sprintf("has %d URNs, only indexing %d", len(c.URNs), contactMaxURNs))
+		c.URNs = c.URNs[:contactMaxURNs]
+	}
+	for n := range c.URNs {
+		u := &c.URNs[n]
+		if utf8.RuneCountInString(u.Path) > contactMaxURNLength {
+			u.Path = truncate(u.Path, contactMaxURNLength)
+			problems = append(problems, fmt.Sprintf("%s URN is too long", u.Scheme))
+		}
+		if u.Display != nil && utf8.RuneCountInString(*u.Display) > contactMaxURNLength {
+			display := truncate(*u.Display, contactMaxURNLength)
+			u.Display = &display
+			problems = append(problems, fmt.Sprintf("%s URN display is too long", u.Scheme))
+		}
+	}
+
+	if len(c.Fields) > contactMaxFields {
+		problems = append(problems, fmt.Sprintf("has %d field values, only indexing %d", len(c.Fields), contactMaxFields))
+		c.Fields = c.Fields[:contactMaxFields]
+	}
+	for n := range c.Fields {
+		f := &c.Fields[n]
+
+		if utf8.RuneCountInString(f.Text) > contactMaxTextLength {
+			f.Text = truncate(f.Text, contactMaxTextLength)
+			problems = append(problems, fmt.Sprintf("field %s text is too long", f.Field))
+		}
+		if f.Number != "" && !validNumber(string(f.Number)) {
+			f.Number = ""
+			problems = append(problems, fmt.Sprintf("field %s number is out of range", f.Field))
+		}
+		if f.Datetime != "" {
+			if _, err := time.Parse(time.RFC3339Nano, f.Datetime); err != nil {
+				f.Datetime = ""
+				problems = append(problems, fmt.Sprintf("field %s datetime is invalid", f.Field))
+			}
+		}
+	}
+
+	return problems
+}
+
+// checks that the given number can be indexed
+func validNumber(s string) bool {
+	n, _, err := big.ParseFloat(s, 10, 64, big.ToNearestEven)
+	if err != nil {
+		return false
+	}
+	return n.Abs(n).Cmp(contactMaxNumber) < 0
+}
+
+// truncates the given string to the given number of characters
+func truncate(s string, length int) string {
+	n := 0
+	for i := range s {
+		if n == length {
+			return s[:i]
+		}
+		n++
+	}
+	return s
+}
@@ -0,0 +1,61 @@
+package indexers_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nyaruka/rp-indexer/v10/indexers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContactDocSanitize(t *testing.T) {
+	// nothing to fix
+	name := "Bob"
+	doc := &indexers.ContactDoc{
+		ID:     1,
+		Name:   &name,
+		URNs:   []indexers.ContactURN{{Scheme: "tel", Path: "+12067791111"}},
+		Fields: []indexers.ContactField{{Field: "05bca1cd-e322-4837-9595-86d0d85e5adb", Text: "-12.5", Number: "-12.5"}},
+	}
+	assert.Nil(t, doc.Sanitize())
+	assert.Equal(t, "Bob", *doc.Name)
+	assert.Equal(t, "-12.5", string(doc.Fields[0].Number))
+
+	longName := strings.Repeat("é", 130)
+	longDisplay := strings.Repeat("d", 260)
+	fields := make([]indexers.ContactField, 252)
+	fields[0] = indexers.ContactField{Field: "f1", Text: strings.Repeat("x", 700)}
+	fields[1] = indexers.ContactField{Field: "f2", Text: "8888888888888888888", Number: "8888888888888888888"}
+	fields[2] = indexers.ContactField{Field: "f3", Text: "-100000000000000", Number: "-100000000000000"}
+	fields[3] = indexers.ContactField{Field: "f4", Text: "99999999999999", Number: "99999999999999"}
+	fields[4] = indexers.ContactField{Field: "f5", Text: "yesterday", Datetime: "yesterday"}
+	fields[5] = indexers.ContactField{Field: "f6", Datetime: "2018-04-06T18:37:59.123456+00:00"}
+
+	doc = &indexers.ContactDoc{
+		ID:     2,
+		Name:   &longName,
+		URNs:   []indexers.ContactURN{{Scheme: "ext", Path: strings.Repeat("1", 300), Display: &longDisplay}},
+		Fields: fields,
+	}
+	assert.Equal(t, []string{
+		"name is too long",
+		"ext URN is too long",
+		"ext URN display is too long",
+		"has 252 field values, only indexing 250",
+		"field f1 text is too long",
+		"field f2 number is out of range",
+		"field f3 number is out of range",
+		"field f5 datetime is invalid",
+	}, doc.Sanitize())
+
+	assert.Equal(t, strings.Repeat("é", 128), *doc.Name)
+	assert.Len(t, doc.URNs[0].Path, 255)
+	assert.Len(t, *doc.URNs[0].Display, 255)
+	assert.Len(t, doc.Fields, 250)
+	assert.Len(t, doc.Fields[0].Text, 640)
+	assert.Equal(t, indexers.ContactField{Field: "f2", Text: "8888888888888888888"}, doc.Fields[1])
+	assert.Equal(t, indexers.ContactField{Field: "f3", Text: "-100000000000000"}, doc.Fields[2])
+	assert.Equal(t, "99999999999999", string(doc.Fields[3].Number))
+	assert.Equal(t, indexers.ContactField{Field: "f5", Text: "yesterday"}, doc.Fields[4])
+	assert.Equal(t, "2018-04-06T18:37:59.123456+00:00", doc.Fields[5].Datetime)
+}
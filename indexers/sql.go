@@ -0,0 +1,207 @@
+package indexers
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nyaruka/rp-indexer/v10/runtime"
+	"github.com/nyaruka/rp-indexer/v10/utils"
+)
+
+// SQLIndexerSpec is how a deployment declares an indexer without writing code. The query takes a modified time as
+// its only parameter and should return rows of (org_id, id, modified_on, is_active, json) modified on or after that,
+// in order of modified_on and limited to a reasonable batch size. The JSON documents must include modified_on and
+// modified_on_mu (modified_on as microseconds since the epoch) so that we can find where to resume from.
+type SQLIndexerSpec struct {
+	Name              string `json:"name"`                // the alias to use for the index
+	Definition        string `json:"definition"`          // path of the index definition, relative to the config file
+	Query             string `json:"query"`               // query to fetch modified records
+	LastModifiedQuery string `json:"last_modified_query"` // query to fetch the newest modified_on, used for lag
+	Shards            *int   `json:"shards"`              // defaults to 2
+	Replicas          *int   `json:"replicas"`            // defaults to 1, can be 0 for single node clusters
+	BulkWorkers       int    `json:"bulk_workers"`
+	BulkMaxDocs       int    `json:"bulk_max_docs"`
+	BulkMaxBytes      int    `json:"bulk_max_bytes"`
+}
+
+// SQLIndexer is an indexer for records fetched by a query declared in configuration
+type SQLIndexer struct {
+	baseIndexer
+
+	query             string
+	lastModifiedQuery string
+	workers           int
+
+	watermarkIndex string    // the physical index our watermark is for
+	watermark      time.Time // last modified time of what we've indexed
+}
+
+// NewSQLIndexer creates a new indexer from the given spec and index definition
+func NewSQLIndexer(elasticURL string, spec *SQLIndexerSpec, def []byte) *SQLIndexer {
+	return &SQLIndexer{
+		baseIndexer:       newBaseIndexer(elasticURL, spec.Name, newIndexDefinition(def, *spec.Shards, *spec.Replicas), spec.BulkMaxDocs, spec.BulkMaxBytes),
+		query:             spec.Query,
+		lastModifiedQuery: spec.LastModifiedQuery,
+		workers:           spec.BulkWorkers,
+	}
+}
+
+// LoadSQLIndexers loads the indexers declared in the given JSON config file
+func LoadSQLIndexers(elasticURL, path string) ([]*SQLIndexer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading indexers config: %w", err)
+	}
+
+	var specs []*SQLIndexerSpec
+	if err := json.Unmarshal(data, &specs); err != nil {
+		return nil, fmt.Errorf("error parsing indexers config: %w", err)
+	}
+
+	idxrs := make([]*SQLIndexer, len(specs))
+	names := make(map[string]bool, len(specs))
+
+	for n, spec := range specs {
+		if spec.Name == "" || spec.Definition == "" || spec.Query == "" || spec.LastModifiedQuery == "" {
+			return nil, fmt.Errorf("indexer #%d must have a name, definition, query and last_modified_query", n)
+		}
+		if names[spec.Name] {
+			return nil, fmt.Errorf("indexer name '%s' is used more than once", spec.Name)
+		}
+		names[spec.Name] = true
+
+		defPath := spec.Definition
+		if !filepath.IsAbs(defPath) {
+			defPath = filepath.Join(filepath.Dir(path), defPath)
+		}
+
+		def, err := os.ReadFile(defPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading definition for indexer '%s': %w", spec.Name, err)
+		}
+		if !json.Valid(def) {
+			return nil, fmt.Errorf("definition for indexer '%s' isn't valid JSON", spec.Name)
+		}
+
+		// apply defaults which match those of the contacts indexer
+		if spec.Shards == nil {
+			shards := 2
+			spec.Shards = &shards
+		}
+		if spec.Replicas == nil {
+			replicas := 1
+			spec.Replicas = &replicas
+		}
+		spec.BulkWorkers = cmp.Or(spec.BulkWorkers, 1)
+		spec.BulkMaxDocs = cmp.Or(spec.BulkMaxDocs, 5000)
+		spec.BulkMaxBytes = cmp.Or(spec.BulkMaxBytes, 10_000_000)
+
+		if spec.BulkWorkers < 0 || spec.BulkMaxDocs < 0 || spec.BulkMaxBytes < 0 {
+			return nil, fmt.Errorf("indexer '%s' can't have negative bulk_workers, bulk_max_docs or bulk_max_bytes", spec.Name)
+		}
+
+		idxrs[n] = NewSQLIndexer(elasticURL, spec, def)
+	}
+
+	return idxrs, nil
+}
+
+// Index indexes modified records and returns the name of the concrete index
+func (i *SQLIndexer) Index(ctx context.Context, rt *runtime.Runtime, rebuild, cleanup bool) (string, error) {
+	var err error
+
+	// don't start if the cluster is struggling
+	if err := i.pressure.Wait(ctx); err != nil {
+		return "", fmt.Errorf("error waiting for cluster: %w", err)
+	}
+
+	// find our physical index
+	physicalIndexes := i.FindIndexes(ctx)
+
+	physicalIndex := ""
+	if len(physicalIndexes) > 0 {
+		physicalIndex = physicalIndexes[0]
+	}
+
+	// whether we need to remap our alias after building
+	remapAlias := false
+
+	// doesn't exist or we are rebuilding, create it
+	if physicalIndex == "" || rebuild {
+		physicalIndex, err = i.createNewIndex(ctx, i.definition)
+		if err != nil {
+			return "", fmt.Errorf("error creating new index: %w", err)
+		}
+		i.log().Info("created new physical index", "index", physicalIndex)
+		remapAlias = true
+	}
+
+	// warn if the index needs rebuilt to use our current definition
+	if !rebuild {
+		if err := i.checkDefinition(ctx, physicalIndex); err != nil {
+			return "", err
+		}
+	}
+
+	// watermarks only apply to the physical index they were read from
+	lastModified := i.watermark
+	if i.watermarkIndex != physicalIndex {
+		lastModified, err = i.findESLastModified(ctx, physicalIndex, nil)
+		if err != nil {
+			return "", fmt.Errorf("error finding last modified: %w", err)
+		}
+	}
+
+	lag, err := utils.ReplicationLag(ctx, rt.DB)
+	if err != nil {
+		return "", fmt.Errorf("error checking replication lag: %w", err)
+	}
+
+	i.log().Debug("indexing newer than last modified", "index", physicalIndex, "last_modified", lastModified)
+
+	noProgress := func(time.Time, int64) error { return nil }
+
+	indexedModified, err := i.indexModified(ctx, physicalIndex, lastModified.Add(-(indexLookback + lag)), rebuild, i.workers, fetchByQuery(rt.DB, i.query), noProgress)
+	if err != nil {
+		return "", fmt.Errorf("error indexing documents: %w", err)
+	}
+
+	if indexedModified.After(lastModified) {
+		lastModified = indexedModified
+	}
+	i.watermarkIndex = physicalIndex
+	i.watermark = lastModified
+	i.stats.LastModified = lastModified
+
+	// if the index didn't previously exist or we are rebuilding, remap to our alias
+	if remapAlias {
+		if err := i.updateAlias(ctx, physicalIndex); err != nil {
+			return "", fmt.Errorf("error updating alias: %w", err)
+		}
+	}
+
+	// cleanup our aliases if appropriate
+	if cleanup {
+		if err := i.cleanupIndexes(ctx, rt.Config.Retain, rt.Config.SnapshotRepository); err != nil {
+			return "", fmt.Errorf("error cleaning up old indexes: %w", err)
+		}
+	}
+
+	return physicalIndex, nil
+}
+
+func (i *SQLIndexer) GetDBLastModified(ctx context.Context, db *sql.DB) (time.Time, error) {
+	var lastModified sql.NullTime
+
+	if err := db.QueryRowContext(ctx, i.lastModifiedQuery).Scan(&lastModified); err != nil {
+		return time.Time{}, err
+	}
+
+	return lastModified.Time, nil
+}
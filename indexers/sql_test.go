@@ -0,0 +1,123 @@
+package indexers_test
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nyaruka/gocommon/elastic"
+	"github.com/nyaruka/rp-indexer/v10/indexers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSQLIndexersConfig = `[
+	{
+		"name": "indexer_sql_test",
+		"definition": "names.index.json",
+		"query": "SELECT org_id, id, modified_on, is_active, row_to_json(t) FROM (SELECT id, org_id, name, is_active, modified_on, EXTRACT(EPOCH FROM modified_on) * 1000000 AS modified_on_mu FROM contacts_contact WHERE modified_on >= $1 ORDER BY modified_on ASC LIMIT 100000) t",
+		"last_modified_query": "SELECT MAX(modified_on) FROM contacts_contact",
+		"shards": 1,
+		"replicas": 0,
+		"bulk_max_docs": 4
+	}
+]`
+
+const testSQLIndexDefinition = `{
+	"settings": {"index": {}},
+	"mappings": {
+		"properties": {
+			"id": {"type": "long"},
+			"org_id": {"type": "integer"},
+			"name": {"type": "text"},
+			"modified_on": {"type": "date"},
+			"modified_on_mu": {"type": "long"}
+		}
+	}
+}`
+
+func TestLoadSQLIndexers(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "indexers.json")
+
+	require.NoError(t, os.WriteFile(configPath, []byte(testSQLIndexersConfig), 0644))
+
+	// definition file doesn't exist
+	_, err := indexers.LoadSQLIndexers("http://localhost:9200", configPath)
+	assert.ErrorContains(t, err, "error reading definition for indexer 'indexer_sql_test'")
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "names.index.json"), []byte(testSQLIndexDefinition), 0644))
+
+	idxrs, err := indexers.LoadSQLIndexers("http://localhost:9200", configPath)
+	assert.NoError(t, err)
+	assert.Len(t, idxrs, 1)
+	assert.Equal(t, "indexer_sql_test", idxrs[0].Name())
+
+	require.NoError(t, os.WriteFile(configPath, []byte(`[{"name": "foo", "definition": "names.index.json"}]`), 0644))
+
+	_, err = indexers.LoadSQLIndexers("http://localhost:9200", configPath)
+	assert.EqualError(t, err, "indexer #0 must have a name, definition, query and last_modified_query")
+
+	require.NoError(t, os.WriteFile(configPath, []byte(`[{"name": "foo", "definition": "names.index.json", "query": "SELECT 1", "last_modified_query": "SELECT 1", "bulk_max_docs": -1}]`), 0644))
+
+	_, err = indexers.LoadSQLIndexers("http://localhost:9200", configPath)
+	assert.EqualError(t, err, "indexer 'foo' can't have negative bulk_workers, bulk_max_docs or bulk_max_bytes")
+}
+
+func TestSQLIndexer(t *testing.T) {
+	ctx := context.Background()
+	rt := setup(t)
+
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, "indexers.json")
+	require.NoError(t, os.WriteFile(configPath, []byte(testSQLIndexersConfig), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "names.index.json"), []byte(testSQLIndexDefinition), 0644))
+
+	idxrs, err := indexers.LoadSQLIndexers(rt.Config.ElasticURL, configPath)
+	require.NoError(t, err)
+	ix := idxrs[0]
+
+	// delete any indexes left over from previous runs
+	for name := range elasticRequest(t, rt.Config, http.MethodGet, "/_aliases", nil) {
+		if strings.HasPrefix(name, "indexer_sql_test") {
+			elasticRequest(t, rt.Config, http.MethodDelete, "/"+name, nil)
+		}
+	}
+
+	expectedIndexName := "indexer_sql_test_" + time.Now().Format("2006_01_02")
+
+	indexName, err := ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expectedIndexName, indexName)
+	assertIndexerStats(t, ix, 9, 0)
+
+	// explicit zero replicas is respected
+	settings := elasticRequest(t, rt.Config, http.MethodGet, "/"+indexName+"/_settings", nil)
+	indexSettings := settings[indexName].(map[string]any)["settings"].(map[string]any)["index"].(map[string]any)
+	assert.Equal(t, "1", indexSettings["number_of_shards"])
+	assert.Equal(t, "0", indexSettings["number_of_replicas"])
+
+	lastModified, err := ix.GetDBLastModified(ctx, rt.DB)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Date(2017, 11, 10, 21, 11, 59, 890662000, time.UTC), lastModified.UTC())
+
+	_, err = rt.DB.Exec(`UPDATE contacts_contact SET name = 'Bob', modified_on = NOW() WHERE id = 2`)
+	require.NoError(t, err)
+	_, err = rt.DB.Exec(`UPDATE contacts_contact SET is_active = FALSE, modified_on = NOW() WHERE id = 3`)
+	require.NoError(t, err)
+
+	_, err = ix.Index(ctx, rt, false, false)
+	assert.NoError(t, err)
+	assertIndexerStats(t, ix, 10, 1)
+
+	time.Sleep(1 * time.Second)
+
+	results := elasticRequest(t, rt.Config, http.MethodPost, "/indexer_sql_test/_search", map[string]any{"query": elastic.Match("name", "bob")})
+	hits := results["hits"].(map[string]any)["hits"].([]any)
+	require.Len(t, hits, 1)
+	assert.Equal(t, "2", hits[0].(map[string]any)["_id"])
+}
@@ -1,14 +1,34 @@
 package runtime
 
+import "fmt"
+
 type Config struct {
 	ElasticURL string `help:"the url for our elastic search instance"`
 	DB         string `help:"the connection string for our database"`
 	Poll       int    `help:"the number of seconds to wait between checking for database updates"`
 	Rebuild    bool   `help:"whether to rebuild the index, swapping it when complete, then exiting (default false)"`
 	Cleanup    bool   `help:"whether to remove old indexes after a rebuild"`
+	Retain     int    `help:"the number of old indexes to keep when cleaning up after a rebuild"`
+	Rollback   bool   `help:"whether to point the alias back at the previous index, then exiting (default false)"`
+	Ignored    bool   `help:"whether to report values in the contact index that elastic search ignored, then exiting (default false)"`
 	LogLevel   string `help:"the log level, one of error, warn, info, debug"`
 	SentryDSN  string `help:"the sentry configuration to log errors to, if any"`
 
+	SnapshotRepository string `help:"the snapshot repository to snapshot old indexes to before removing them, if any"`
+	LeaderLock         bool   `help:"whether to use postgres advisory locks so that only one instance runs each indexer at a time"`
+	ElasticGzip        bool   `help:"whether to gzip compress larger requests to elastic search"`
+	WatermarkFile      string `help:"the local file to store indexing watermarks in, if any"`
+	WatermarkDB        string `help:"the connection string for a writable database to store indexing watermarks in, if any"`
+	SQLIndexers        string `help:"a JSON file declaring additional indexers defined by SQL queries, if any"`
+
+	RebuildValidate        bool    `help:"whether to check a rebuilt index is green and has the expected number of documents before switching to it"`
+	RebuildValidateOrgs    bool    `help:"whether validating a rebuilt index also checks the number of documents for each org"`
+	RebuildTolerance       float64 `help:"the fraction by which the number of documents in a rebuilt index can differ from the number of contacts"`
+	RebuildGreenTimeout    int     `help:"the number of seconds to wait for a rebuilt index to become green when validating it"`
+	RebuildOptimize        bool    `help:"whether to build new indexes without replicas or refreshes, restoring those before switching to them"`
+	RebuildForceMerge      bool    `help:"whether to force merge new indexes built with optimized settings before adding replicas"`
+	RebuildReplicasTimeout int     `help:"the number of seconds to wait for the replicas of new indexes built with optimized settings to be allocated"`
+
 	AWSAccessKeyID     string `help:"access key ID to use for AWS services"`
 	AWSSecretAccessKey string `help:"secret access key to use for AWS services"`
 	AWSRegion          string `help:"region to use for AWS services, e.g. us-east-1"`
@@ -16,9 +36,16 @@ type Config struct {
 	CloudwatchNamespace string `help:"the namespace to use for cloudwatch metrics"`
 	DeploymentID        string `help:"the deployment identifier to use for metrics"`
 
-	ContactsIndex    string `help:"the alias to use for the contact index"`
-	ContactsShards   int    `help:"the number of shards to use for the contacts index"`
-	ContactsReplicas int    `help:"the number of replicas to use for the contacts index"`
+	ContactsIndex        string `help:"the alias to use for the contact index"`
+	ContactsShards       int    `help:"the number of shards to use for the contacts index"`
+	ContactsReplicas     int    `help:"the number of replicas to use for the contacts index"`
+	ContactsBulkWorkers  int    `help:"the number of concurrent bulk requests to use when indexing contacts"`
+	ContactsBulkMaxDocs  int    `help:"the maximum number of contacts in each bulk request, which are otherwise adjusted based on latency"`
+	ContactsBulkMaxBytes int    `help:"the maximum size in bytes of each bulk request when indexing contacts"`
+	ContactsHashCache    int    `help:"the number of contact content hashes to keep so that unchanged contacts aren't reindexed, 0 to disable"`
+
+	ContactsPartitions      int    `help:"the number of partitions to split contact indexing into by org, 0 to disable"`
+	ContactsPartitionsOwned string `help:"comma separated list of the contact partitions this instance indexes, e.g. 0,2 (default all)"`
 }
 
 func NewDefaultConfig() *Config {
@@ -28,8 +55,26 @@ func NewDefaultConfig() *Config {
 		Poll:       5,
 		Rebuild:    false,
 		Cleanup:    false,
+		Retain:     0,
+		Rollback:   false,
+		Ignored:    false,
 		LogLevel:   "info",
 
+		SnapshotRepository: "",
+		LeaderLock:         false,
+		ElasticGzip:        false,
+		WatermarkFile:      "",
+		WatermarkDB:        "",
+		SQLIndexers:        "",
+
+		RebuildValidate:        false,
+		RebuildValidateOrgs:    false,
+		RebuildTolerance:       0.01,
+		RebuildGreenTimeout:    60,
+		RebuildOptimize:        false,
+		RebuildForceMerge:      false,
+		RebuildReplicasTimeout: 3600,
+
 		AWSAccessKeyID:     "",
 		AWSSecretAccessKey: "",
 		AWSRegion:          "us-east-1",
@@ -37,8 +82,26 @@ func NewDefaultConfig() *Config {
 		CloudwatchNamespace: "Temba/Indexer",
 		DeploymentID:        "dev",
 
-		ContactsIndex:    "contacts",
-		ContactsShards:   2,
-		ContactsReplicas: 1,
+		ContactsIndex:        "contacts",
+		ContactsShards:       2,
+		ContactsReplicas:     1,
+		ContactsBulkWorkers:  1,
+		ContactsBulkMaxDocs:  5000,
+		ContactsBulkMaxBytes: 10_000_000,
+		ContactsHashCache:    0,
+
+		ContactsPartitions:      0,
+		ContactsPartitionsOwned: "",
+	}
+}
+
+// Validate checks that the config values which can't be checked by type alone are valid
+func (c *Config) Validate() error {
+	if c.ContactsBulkMaxDocs <= 0 {
+		return fmt.Errorf("contacts-bulk-max-docs must be greater than 0")
+	}
+	if c.ContactsBulkMaxBytes <= 0 {
+		return fmt.Errorf("contacts-bulk-max-bytes must be greater than 0")
 	}
+	return nil
 }
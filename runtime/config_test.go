@@ -0,0 +1,20 @@
+package runtime_test
+
+import (
+	"testing"
+
+	"github.com/nyaruka/rp-indexer/v10/runtime"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfigValidate(t *testing.T) {
+	cfg := runtime.NewDefaultConfig()
+	assert.NoError(t, cfg.Validate())
+
+	cfg.ContactsBulkMaxDocs = 0
+	assert.EqualError(t, cfg.Validate(), "contacts-bulk-max-docs must be greater than 0")
+
+	cfg = runtime.NewDefaultConfig()
+	cfg.ContactsBulkMaxBytes = -1
+	assert.EqualError(t, cfg.Validate(), "contacts-bulk-max-bytes must be greater than 0")
+}
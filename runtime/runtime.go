@@ -5,10 +5,13 @@ import (
 
 	_ "github.com/lib/pq"
 	"github.com/nyaruka/gocommon/aws/cwatch"
+	"github.com/nyaruka/rp-indexer/v10/watermarks"
 )
 
 type Runtime struct {
 	Config *Config
 	DB     *sql.DB
 	CW     *cwatch.Service
+
+	Watermarks watermarks.Store // optional durable store of indexing watermarks
 }
@@ -24,6 +24,17 @@ CREATE TABLE contacts_contact (
     ticket_count integer NOT NULL
 );
 
+DROP TABLE IF EXISTS contacts_contactfield CASCADE;
+CREATE TABLE contacts_contactfield (
+    id SERIAL PRIMARY KEY,
+    is_active boolean NOT NULL,
+    uuid uuid NOT NULL,
+    org_id integer NOT NULL,
+    key character varying(36) NOT NULL,
+    name character varying(36) NOT NULL,
+    value_type character varying(1) NOT NULL
+);
+
 DROP TABLE IF EXISTS contacts_contacturn CASCADE;
 CREATE TABLE contacts_contacturn (
     id SERIAL PRIMARY KEY,
@@ -66,26 +77,27 @@ INSERT INTO flows_flow(id, uuid, name) VALUES
 (1, '6d3cf1eb-546e-4fb8-a5ca-69187648fbf6', 'Favorites'),
 (2, '4eea8ff1-4fe2-4ce5-92a4-0870a499973a', 'Catch All');
 
--- Fields:
--- 17103bb1-1b48-4b70-92f7-1f6b73bd3488 - nickname (text)
--- 05bca1cd-e322-4837-9595-86d0d85e5adb - age (numeric)
--- e0eac267-463a-4c00-9732-cab62df07b16 - joined_on (datetime)
--- 22d11697-edba-4186-b084-793e3b876379 - home_state (state)
--- fcab2439-861c-4832-aa54-0c97f38f24ab - home_district (district)
--- a551ade4-e5a0-4d83-b185-53b515ad2f2a - home_ward (ward)
+INSERT INTO contacts_contactfield(id, is_active, uuid, org_id, key, name, value_type) VALUES
+(1, TRUE, '17103bb1-1b48-4b70-92f7-1f6b73bd3488', 1, 'nickname', 'Nickname', 'T'),
+(2, TRUE, '05bca1cd-e322-4837-9595-86d0d85e5adb', 1, 'age', 'Age', 'N'),
+(3, TRUE, 'e0eac267-463a-4c00-9732-cab62df07b16', 1, 'joined_on', 'Joined On', 'D'),
+(4, FALSE, 'f1b5aea6-6586-41c7-9020-1a6326cc6565', 1, 'old_nickname', 'Old Nickname', 'T'),
+(5, TRUE, '22d11697-edba-4186-b084-793e3b876379', 2, 'home_state', 'Home State', 'S'),
+(6, TRUE, 'fcab2439-861c-4832-aa54-0c97f38f24ab', 2, 'home_district', 'Home District', 'I'),
+(7, TRUE, 'a551ade4-e5a0-4d83-b185-53b515ad2f2a', 2, 'home_ward', 'Home Ward', 'W');
 
 INSERT INTO contacts_contact(id, is_active, created_by_id, created_on, modified_by_id, modified_on, last_seen_on, org_id, status, name, language, uuid, fields, ticket_count, current_flow_id) VALUES
 (
     1,  
     TRUE, -1, '2017-11-10 21:11:59.890662+00', -1, '2017-11-10 21:11:59.890662+00', '2020-08-04 21:11', 1, 'A', NULL, 'eng', 'c7a2dd87-a80e-420b-8431-ca48d422e924', 
-    '{ "17103bb1-1b48-4b70-92f7-1f6b73bd3488": {"text": "the rock"}}', 
+    '{ "17103bb1-1b48-4b70-92f7-1f6b73bd3488": {"text": "the rock"}, "f1b5aea6-6586-41c7-9020-1a6326cc6565": {"text": "rocky"}}', 
     2,
     NULL
 ),
 (
     2,  
     TRUE, -1, '2015-03-26 10:07:14.054521+00', -1, '2015-03-26 10:07:14.054521+00', '2020-08-03 13:11', 1, 'S', NULL, NULL, '7a6606c7-ff41-4203-aa98-454a10d37209',
-    '{ "05bca1cd-e322-4837-9595-86d0d85e5adb": {"text": "11", "number": 11 }}', 
+    '{ "05bca1cd-e322-4837-9595-86d0d85e5adb": {"text": "11", "number": 11 }, "legacy": {"text": "not a field UUID"}}', 
     1,
     1
 ),
@@ -139,18 +151,18 @@ INSERT INTO contacts_contact(id, is_active, created_by_id, created_on, modified_
     NULL
 );
 
-INSERT INTO contacts_contacturn(id, contact_id, scheme, org_id, priority, path, display, identity) VALUES
-(1, 1, 'tel', 1, 50, '+12067791111', NULL, 'tel:+12067791111'),
-(2, 1, 'tel', 1, 50, '+12067792222', NULL, 'tel:+12067792222'),
-(3, 2, 'tel', 1, 50, '+12067794444', NULL, 'tel:+12067794444'),
-(4, 3, 'tel', 1, 50, '+12067795555', NULL, 'tel:+12067795555'),
-(5, 4, 'tel', 1, 50, '+12060000556', NULL, 'tel:+12067796666'),
-(6, 5, 'tel', 2, 50, '+12060005577', NULL, 'tel:+12067797777'),
-(7, 6, 'tel', 2, 50, '+12067798888', NULL, 'tel:+12067798888'),
-(8, 7, 'viber', 2, 90, 'viberpath==', NULL, 'viber:viberpath=='),
-(9, 8, 'facebook', 2, 90, 1000001, 'funguy', 'facebook:1000001'),
-(10, 9, 'twitterid', 2, 90, 1000001, 'fungal', 'twitterid:1000001'),
-(11, 10, 'whatsapp',  2, 90, 1000003, NULL, 'whatsapp:1000003');
+INSERT INTO contacts_contacturn(id, contact_id, scheme, org_id, priority, path, display, identity, channel_id) VALUES
+(1, 1, 'tel', 1, 50, '+12067791111', NULL, 'tel:+12067791111', NULL),
+(2, 1, 'tel', 1, 40, '+12067792222', NULL, 'tel:+12067792222', NULL),
+(3, 2, 'tel', 1, 50, '+12067794444', NULL, 'tel:+12067794444', NULL),
+(4, 3, 'tel', 1, 50, '+12067795555', NULL, 'tel:+12067795555', NULL),
+(5, 4, 'tel', 1, 50, '+12060000556', NULL, 'tel:+12067796666', NULL),
+(6, 5, 'tel', 2, 50, '+12060005577', NULL, 'tel:+12067797777', NULL),
+(7, 6, 'tel', 2, 50, '+12067798888', NULL, 'tel:+12067798888', 3),
+(8, 7, 'viber', 2, 90, 'viberpath==', NULL, 'viber:viberpath==', 4),
+(9, 8, 'facebook', 2, 90, 1000001, 'funguy', 'facebook:1000001', 5),
+(10, 9, 'twitterid', 2, 90, 1000001, 'fungal', 'twitterid:1000001', NULL),
+(11, 10, 'whatsapp',  2, 90, 1000003, NULL, 'whatsapp:1000003', NULL);
 
 INSERT INTO contacts_contactgroup(id, uuid, name, group_type) VALUES
 (1, '4ea0f313-2f62-4e57-bdf0-232b5191dd57', 'Group 1', 'Q'),
@@ -0,0 +1,24 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// if this is a replica which hasn't replayed everything it has received, the time since the last transaction it replayed
+const sqlSelectReplicationLag = `
+SELECT CASE
+	WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+	ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+END`
+
+// ReplicationLag returns how far the given database is behind its primary, which is zero if it isn't a replica
+func ReplicationLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	var seconds float64
+	if err := db.QueryRowContext(ctx, sqlSelectReplicationLag).Scan(&seconds); err != nil {
+		return 0, err
+	}
+
+	return time.Duration(max(seconds, 0) * float64(time.Second)), nil
+}
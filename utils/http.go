@@ -2,6 +2,7 @@ package utils
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
@@ -15,6 +16,17 @@ import (
 
 var retryConfig *httpx.RetryConfig
 
+// requests with bodies at least this size are gzip compressed if compression is enabled
+const compressMinBytes = 1024
+
+var compressRequests bool
+
+// SetCompression sets whether larger request bodies are gzip compressed. Compressed responses are always accepted
+// as the default transport asks for them and transparently decompresses them.
+func SetCompression(enabled bool) {
+	compressRequests = enabled
+}
+
 func init() {
 	backoffs := make([]time.Duration, 5)
 	backoffs[0] = 1 * time.Second
@@ -26,6 +38,11 @@ func init() {
 }
 
 func shouldRetry(request *http.Request, response *http.Response, withDelay time.Duration) bool {
+	// no point retrying if the request has been cancelled
+	if request.Context().Err() != nil {
+		return false
+	}
+
 	// no response is a connection timeout which we can retry
 	if response == nil {
 		return true
@@ -33,9 +50,10 @@ func shouldRetry(request *http.Request, response *http.Response, withDelay time.
 
 	// 429 Too Many Requests is recoverable. Sometimes the server puts
 	// a Retry-After response header to indicate when the server is
-	// available to start processing request from client.
+	// available to start processing request from client. If that's longer
+	// than we'd wait, we leave it to the caller to back off.
 	if response.StatusCode == http.StatusTooManyRequests {
-		return true
+		return httpx.ParseRetryAfter(response.Header.Get("Retry-After")) <= withDelay
 	}
 
 	// check for unexpected EOF
@@ -50,14 +68,44 @@ func shouldRetry(request *http.Request, response *http.Response, withDelay time.
 	return false
 }
 
+// ThrottledError is returned when ES is still rejecting our requests as too many after retrying
+type ThrottledError struct {
+	RetryAfter time.Duration // how long ES asked us to wait, if it said
+}
+
+func (e *ThrottledError) Error() string {
+	return "received 429 too many requests response"
+}
+
 // MakeJSONRequest is a utility function to make a JSON request, optionally decoding the response into the passed in struct
 func MakeJSONRequest(ctx context.Context, method string, url string, body []byte, dest any) (*http.Response, error) {
+	return makeJSONRequest(ctx, method, url, body, dest, slog.LevelError)
+}
+
+// MakeQuietJSONRequest is like MakeJSONRequest but only logs errors at debug level, for callers which handle and log
+// failures themselves, e.g. because they're expected
+func MakeQuietJSONRequest(ctx context.Context, method string, url string, body []byte, dest any) (*http.Response, error) {
+	return makeJSONRequest(ctx, method, url, body, dest, slog.LevelDebug)
+}
+
+func makeJSONRequest(ctx context.Context, method string, url string, body []byte, dest any, errorLevel slog.Level) (*http.Response, error) {
 	l := slog.With("url", url, "method", method)
 
-	req, _ := httpx.NewRequest(ctx, method, url, bytes.NewReader(body), map[string]string{"Content-Type": "application/json"})
+	headers := map[string]string{"Content-Type": "application/json"}
+
+	if compressRequests && len(body) >= compressMinBytes {
+		compressed, err := gzipBytes(body)
+		if err != nil {
+			return nil, fmt.Errorf("error compressing request body: %w", err)
+		}
+		body = compressed
+		headers["Content-Encoding"] = "gzip"
+	}
+
+	req, _ := httpx.NewRequest(ctx, method, url, bytes.NewReader(body), headers)
 	resp, err := httpx.Do(http.DefaultClient, req, retryConfig, nil)
 	if err != nil {
-		l.Error("error making request", "error", err)
+		l.Log(ctx, errorLevel, "error making request", "error", err)
 		return resp, err
 	}
 	defer resp.Body.Close()
@@ -65,25 +113,44 @@ func MakeJSONRequest(ctx context.Context, method string, url string, body []byte
 	// if we have a body, try to decode it
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		l.Error("error reading response", "error", err)
+		l.Log(ctx, errorLevel, "error reading response", "error", err)
 		return resp, err
 	}
 
 	l = l.With("response", string(respBody), "status", resp.StatusCode)
 
+	// ES is too busy, let caller decide when to try again
+	if resp.StatusCode == http.StatusTooManyRequests {
+		l.Warn("ES rejected request as too many")
+		return resp, &ThrottledError{RetryAfter: httpx.ParseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
 	// error if we got a non-200
 	if resp.StatusCode != http.StatusOK {
-		l.Error("error reaching ES", "error", err)
+		l.Log(ctx, errorLevel, "error reaching ES", "error", err)
 		return resp, fmt.Errorf("received non-200 response %d: %s", resp.StatusCode, respBody)
 	}
 
 	if dest != nil {
 		err = json.Unmarshal(respBody, dest)
 		if err != nil {
-			l.Error("error unmarshalling response", "error", err)
+			l.Log(ctx, errorLevel, "error unmarshalling response", "error", err)
 			return resp, err
 		}
 	}
 
 	return resp, nil
 }
+
+func gzipBytes(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
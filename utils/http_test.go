@@ -1,10 +1,14 @@
 package utils_test
 
 import (
+	"compress/gzip"
 	"context"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/nyaruka/rp-indexer/v10/utils"
 	"github.com/stretchr/testify/assert"
@@ -41,3 +45,84 @@ func TestRetryServer(t *testing.T) {
 
 	require.Equal(t, responseCounter, 4)
 }
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+
+	var lastEncoding string
+	var lastBody []byte
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lastEncoding = r.Header.Get("Content-Encoding")
+
+		var body io.Reader = r.Body
+		if lastEncoding == "gzip" {
+			body, _ = gzip.NewReader(r.Body)
+		}
+		lastBody, _ = io.ReadAll(body)
+
+		// respond with a compressed body if client accepts it
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write([]byte(`{"foo": 1}`))
+			gz.Close()
+		} else {
+			w.Write([]byte(`{"foo": 1}`))
+		}
+	}))
+	defer ts.Close()
+
+	small := []byte(`{"query": {}}`)
+	large := []byte(`{"query": {"terms": {"name": ["` + strings.Repeat("bob", 1000) + `"]}}}`)
+	dest := &struct {
+		Foo int `json:"foo"`
+	}{}
+
+	// by default nothing is compressed
+	_, err := utils.MakeJSONRequest(ctx, "POST", ts.URL, large, dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "", lastEncoding)
+	assert.Equal(t, large, lastBody)
+	assert.Equal(t, 1, dest.Foo)
+
+	utils.SetCompression(true)
+	defer utils.SetCompression(false)
+
+	// once enabled, small bodies still aren't compressed
+	_, err = utils.MakeJSONRequest(ctx, "POST", ts.URL, small, dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "", lastEncoding)
+	assert.Equal(t, small, lastBody)
+
+	// but larger bodies are
+	dest.Foo = 0
+	_, err = utils.MakeJSONRequest(ctx, "POST", ts.URL, large, dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "gzip", lastEncoding)
+	assert.Equal(t, large, lastBody)
+	assert.Equal(t, 1, dest.Foo)
+}
+
+func TestThrottled(t *testing.T) {
+	ctx := context.Background()
+
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "120")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": "too many"}`))
+	}))
+	defer ts.Close()
+
+	// server wants us to wait longer than we would so we don't retry but leave it to the caller
+	resp, err := utils.MakeJSONRequest(ctx, "POST", ts.URL, []byte(`{}`), nil)
+	assert.Equal(t, 429, resp.StatusCode)
+	assert.Equal(t, 1, requests)
+
+	var throttled *utils.ThrottledError
+	if assert.ErrorAs(t, err, &throttled) {
+		assert.Equal(t, 2*time.Minute, throttled.RetryAfter)
+	}
+}
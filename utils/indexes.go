@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"cmp"
+	"strconv"
+	"strings"
+)
+
+// CompareIndexNames compares two physical index names of the same alias, e.g. contacts_2025_01_01_9 and
+// contacts_2025_01_01_10, comparing their date and numeric suffix parts as numbers rather than as text.
+func CompareIndexNames(a, b string) int {
+	aParts, bParts := strings.Split(a, "_"), strings.Split(b, "_")
+
+	for n := 0; n < len(aParts) && n < len(bParts); n++ {
+		aNum, aErr := strconv.Atoi(aParts[n])
+		bNum, bErr := strconv.Atoi(bParts[n])
+
+		c := strings.Compare(aParts[n], bParts[n])
+		if aErr == nil && bErr == nil {
+			c = cmp.Compare(aNum, bNum)
+		}
+		if c != 0 {
+			return c
+		}
+	}
+
+	// a name without a numeric suffix is older than one with
+	return cmp.Compare(len(aParts), len(bParts))
+}
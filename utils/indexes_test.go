@@ -0,0 +1,22 @@
+package utils_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/nyaruka/rp-indexer/v10/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareIndexNames(t *testing.T) {
+	assert.Equal(t, 0, utils.CompareIndexNames("contacts_2025_01_01", "contacts_2025_01_01"))
+	assert.Equal(t, -1, utils.CompareIndexNames("contacts_2025_01_01", "contacts_2025_01_02"))
+	assert.Equal(t, 1, utils.CompareIndexNames("contacts_2025_02_01", "contacts_2025_01_31"))
+	assert.Equal(t, -1, utils.CompareIndexNames("contacts_2025_01_01", "contacts_2025_01_01_1"))
+	assert.Equal(t, 1, utils.CompareIndexNames("contacts_2025_01_01_10", "contacts_2025_01_01_9"))
+	assert.Equal(t, -1, utils.CompareIndexNames("contacts_2025_01_01_10", "contacts_2025_01_02"))
+
+	indexes := []string{"sql_test_2025_01_01_2", "sql_test_2025_01_01_10", "sql_test_2025_01_01", "sql_test_2024_12_31_11", "sql_test_2025_01_01_9"}
+	slices.SortFunc(indexes, utils.CompareIndexNames)
+	assert.Equal(t, []string{"sql_test_2024_12_31_11", "sql_test_2025_01_01", "sql_test_2025_01_01_2", "sql_test_2025_01_01_9", "sql_test_2025_01_01_10"}, indexes)
+}
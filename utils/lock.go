@@ -0,0 +1,74 @@
+package utils
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+)
+
+// Lock is a postgres session-level advisory lock which is held on a dedicated connection, so that it is
+// released automatically if this process dies or loses its connection to the database.
+type Lock struct {
+	db   *sql.DB
+	key  int64
+	conn *sql.Conn
+}
+
+// NewLock creates a new advisory lock with the given name
+func NewLock(db *sql.DB, name string) *Lock {
+	h := fnv.New64a()
+	h.Write([]byte("rp-indexer:" + name))
+
+	return &Lock{db: db, key: int64(h.Sum64())}
+}
+
+// Acquire tries to take or keep hold of this lock, returning whether we hold it
+func (l *Lock) Acquire(ctx context.Context) (bool, error) {
+	// if we already hold the lock, check our connection is still alive
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err == nil {
+			return true, nil
+		}
+
+		// connection is gone and the lock with it
+		l.conn.Close()
+		l.conn = nil
+	}
+
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return false, fmt.Errorf("error getting connection: %w", err)
+	}
+
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, `SELECT pg_try_advisory_lock($1)`, l.key).Scan(&acquired); err != nil {
+		conn.Close()
+		return false, fmt.Errorf("error trying advisory lock: %w", err)
+	}
+
+	if !acquired {
+		conn.Close()
+		return false, nil
+	}
+
+	l.conn = conn
+	return true, nil
+}
+
+// Release releases this lock if we hold it
+func (l *Lock) Release(ctx context.Context) error {
+	if l.conn == nil {
+		return nil
+	}
+
+	defer func() {
+		l.conn.Close()
+		l.conn = nil
+	}()
+
+	if _, err := l.conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, l.key); err != nil {
+		return fmt.Errorf("error releasing advisory lock: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package watermarks
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+const sqlCreateTable = `
+CREATE TABLE IF NOT EXISTS indexer_watermark (
+	key VARCHAR(255) PRIMARY KEY,
+	index_name VARCHAR(255) NOT NULL,
+	modified_on TIMESTAMP WITH TIME ZONE NOT NULL,
+	last_id BIGINT NOT NULL,
+	updated_on TIMESTAMP WITH TIME ZONE NOT NULL
+)`
+
+const sqlSelectWatermark = `SELECT index_name, modified_on, last_id, updated_on FROM indexer_watermark WHERE key = $1`
+
+const sqlUpsertWatermark = `
+INSERT INTO indexer_watermark(key, index_name, modified_on, last_id, updated_on) VALUES($1, $2, $3, $4, $5)
+ON CONFLICT (key) DO UPDATE SET index_name = $2, modified_on = $3, last_id = $4, updated_on = $5`
+
+// DBStore is a store of watermarks in a postgres table. This must be a writable database so can't be a read
+// replica that we might be indexing from.
+type DBStore struct {
+	db *sql.DB
+}
+
+// NewDBStore creates a new store of watermarks in the given database, creating its table if needed
+func NewDBStore(ctx context.Context, db *sql.DB) (*DBStore, error) {
+	if _, err := db.ExecContext(ctx, sqlCreateTable); err != nil {
+		return nil, fmt.Errorf("error creating watermarks table: %w", err)
+	}
+
+	return &DBStore{db: db}, nil
+}
+
+// Get gets the watermark with the given key, returning nil if there isn't one
+func (s *DBStore) Get(ctx context.Context, key string) (*Watermark, error) {
+	c := &Watermark{}
+
+	err := s.db.QueryRowContext(ctx, sqlSelectWatermark, key).Scan(&c.Index, &c.ModifiedOn, &c.ID, &c.UpdatedOn)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading watermark: %w", err)
+	}
+	return c, nil
+}
+
+// Set saves the watermark with the given key
+func (s *DBStore) Set(ctx context.Context, key string, c *Watermark) error {
+	if _, err := s.db.ExecContext(ctx, sqlUpsertWatermark, key, c.Index, c.ModifiedOn, c.ID, c.UpdatedOn); err != nil {
+		return fmt.Errorf("error saving watermark: %w", err)
+	}
+	return nil
+}
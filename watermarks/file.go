@@ -0,0 +1,92 @@
+package watermarks
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore is a store of watermarks in a local JSON file
+type FileStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileStore creates a new store of watermarks in the file at the given path
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path}
+}
+
+// Get gets the watermark with the given key, returning nil if there isn't one
+func (s *FileStore) Get(ctx context.Context, key string) (*Watermark, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	return all[key], nil
+}
+
+// Set saves the watermark with the given key
+func (s *FileStore) Set(ctx context.Context, key string, c *Watermark) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	all, err := s.read()
+	if err != nil {
+		return err
+	}
+
+	all[key] = c
+
+	return s.write(all)
+}
+
+func (s *FileStore) read() (map[string]*Watermark, error) {
+	all := make(map[string]*Watermark)
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return all, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading watermarks file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &all); err != nil {
+		return nil, fmt.Errorf("error parsing watermarks file: %w", err)
+	}
+	return all, nil
+}
+
+// writes to a temporary file which is then renamed so that the file is never left partially written
+func (s *FileStore) write(all map[string]*Watermark) error {
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return fmt.Errorf("error creating watermarks file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error writing watermarks file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error writing watermarks file: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("error writing watermarks file: %w", err)
+	}
+	return nil
+}
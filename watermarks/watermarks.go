@@ -0,0 +1,24 @@
+package watermarks
+
+import (
+	"context"
+	"time"
+)
+
+// Watermark records how far an indexer has got indexing into a physical index. Indexing resumes from ModifiedOn,
+// less a lookback window, so ID isn't used as a cursor and is only recorded for auditing.
+type Watermark struct {
+	Index      string    `json:"index"`       // the physical index
+	ModifiedOn time.Time `json:"modified_on"` // modified time of the last record indexed
+	ID         int64     `json:"id"`          // id of the last record indexed, for auditing only
+	UpdatedOn  time.Time `json:"updated_on"`  // when this watermark was saved
+}
+
+// Store is a durable store of watermarks, keyed by indexer and partition
+type Store interface {
+	// Get gets the watermark with the given key, returning nil if there isn't one
+	Get(ctx context.Context, key string) (*Watermark, error)
+
+	// Set saves the watermark with the given key
+	Set(ctx context.Context, key string, c *Watermark) error
+}